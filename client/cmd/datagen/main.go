@@ -0,0 +1,43 @@
+// Command datagen generates synthetic agency files of bets, along with a
+// manifest of the winners the server must report for each agency
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/dataset"
+)
+
+func main() {
+	options := dataset.DefaultOptions()
+	out := flag.String("out", ".data/synthetic", "directory where the agency files and the manifest are written")
+	flag.IntVar(&options.Agencies, "agencies", options.Agencies, "amount of agency files")
+	flag.IntVar(&options.FirstAgency, "first-agency", options.FirstAgency, "id of the first agency, the rest follow it")
+	flag.IntVar(&options.RowsPerAgency, "rows", options.RowsPerAgency, "rows of each agency file")
+	flag.IntVar(&options.WinningNumber, "winning-number", options.WinningNumber, "number drawn by the server")
+	flag.Float64Var(&options.WinnerRatio, "winners", options.WinnerRatio, "fraction of rows betting the winning number")
+	flag.Float64Var(&options.PathologicalRatio, "pathological", options.PathologicalRatio, "fraction of rows with a pathological name")
+	flag.Float64Var(&options.InvalidRatio, "invalid", options.InvalidRatio, "fraction of rows the client must reject")
+	flag.Int64Var(&options.Seed, "seed", options.Seed, "seed of the rows, the same seed always generates the same files")
+	flag.Parse()
+
+	manifest, err := dataset.Generate(*out, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	for _, agency := range manifest.Agencies {
+		fmt.Printf("%v: %d rows, %d bets, %d invalid, %d winners\n",
+			filepath.Join(*out, agency.File),
+			agency.Rows,
+			agency.Bets,
+			len(agency.InvalidLines),
+			len(agency.Winners),
+		)
+	}
+	fmt.Printf("%v\n", filepath.Join(*out, dataset.ManifestFile))
+}
@@ -0,0 +1,92 @@
+// Command loadgen simulates many agencies uploading their bets to a server
+// from a single process, and prints the throughput, acknowledgement latency
+// and errors seen once every agency got its winners or failed
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/loadgen"
+)
+
+var log = logging.MustGetLogger("log")
+
+// initLogger Logs the messages of the clients of the agencies at the given
+// level or above to stderr, leaving stdout to the report
+func initLogger(logLevel string) error {
+	backend := logging.NewLogBackend(os.Stderr, "", 0)
+	format := logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)
+	leveled := logging.AddModuleLevel(logging.NewBackendFormatter(backend, format))
+	level, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	leveled.SetLevel(level, "")
+	logging.SetBackend(leveled)
+	return nil
+}
+
+func main() {
+	options := loadgen.DefaultOptions()
+	flag.StringVar(&options.ServerAddress, "server", options.ServerAddress, "address of the server")
+	flag.IntVar(&options.Agencies, "agencies", options.Agencies, "amount of virtual agencies")
+	flag.IntVar(&options.FirstAgency, "first-agency", options.FirstAgency, "id of the first agency, the rest follow it")
+	flag.IntVar(&options.BetsPerAgency, "bets", options.BetsPerAgency, "synthetic bets uploaded by each agency")
+	flag.StringVar(&options.BetsFiles, "files", options.BetsFiles,
+		"files with the bets of each agency instead of synthetic ones, where "+loadgen.AgencyPlaceholder+" is replaced by its id")
+	flag.Int64Var(&options.Seed, "seed", options.Seed, "seed of the synthetic bets")
+	flag.IntVar(&options.BatchAmount, "batch", options.BatchAmount, "maximum amount of bets per batch")
+	flag.IntVar(&options.BatchMaxSize, "batch-size", options.BatchMaxSize, "maximum size in bytes of a batch")
+	flag.IntVar(&options.BatchWindow, "window", options.BatchWindow, "batches sent without waiting for their acknowledgement")
+	flag.DurationVar(&options.ThinkTime, "think", options.ThinkTime, "time each agency waits between consecutive batches")
+	flag.BoolVar(&options.Compression, "compression", options.Compression, "offer the server to compress the batches")
+	flag.DurationVar(&options.Timeouts.Ack, "ack-timeout", options.Timeouts.Ack, "maximum time to wait for the acknowledgement of a batch")
+	flag.DurationVar(&options.Timeouts.Results, "results-timeout", options.Timeouts.Results, "maximum time to wait for the winners")
+	flag.IntVar(&options.Retry.MaxAttempts, "retries", options.Retry.MaxAttempts, "attempts to connect and to poll for the winners, 0 for unlimited")
+	logLevel := flag.String("log-level", "WARNING", "level of the logs of the agencies")
+	flag.Parse()
+
+	if err := initLogger(*logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level %q: %v\n", *logLevel, err)
+		os.Exit(2)
+	}
+	if err := options.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signalChannel
+		log.Warningf("action: signal_received | result: success | signal: %v", sig)
+		cancel()
+	}()
+
+	log.Infof("action: loadgen | result: in_progress | server_address: %v | agencies: %v",
+		options.ServerAddress,
+		options.Agencies,
+	)
+	report, err := loadgen.Run(ctx, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Print(report)
+	if report.Succeeded < report.Agencies {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BatchAck The acknowledgement of a batch by the server, as reported to
+// ClientConfig.OnBatchAcked
+type BatchAck struct {
+	Seq           uint32
+	Bets          int
+	AlreadyStored bool
+	// Latency is the time from sending the batch to reading its
+	// acknowledgement
+	Latency time.Duration
+}
+
+// sentBatch A batch that was sent to the server and is waiting to be
+// acknowledged
+type sentBatch struct {
+	seq    uint32
+	amount int
+	sentAt time.Time
+	// where each bet was read from, to report the ones rejected by the
+	// server
+	positions []betPosition
+}
+
+// betPosition The file and line a bet was read from
+type betPosition struct {
+	file string
+	line int
+}
+
+// ackResult The outcome of waiting for the acknowledgement of a batch
+type ackResult struct {
+	batch         sentBatch
+	alreadyStored bool
+	latency       time.Duration
+	err           error
+}
+
+// readAcks Reads the acknowledgements sent by the server, matching each of
+// them by sequence number with the batches received through sent, and
+// publishes the result in acks. It returns after publishing an error or once
+// sent is closed and every batch was acknowledged, closing acks. Waiting for
+// an acknowledgement fails once ctx is done
+func readAcks(ctx context.Context, proto *Protocol, sent <-chan sentBatch, acks chan<- ackResult) {
+	defer close(acks)
+
+	pending := make(map[uint32]sentBatch)
+	// The batch is published after being sent, so its acknowledgement may
+	// arrive before it is in pending
+	lookup := func(seq uint32) (sentBatch, bool) {
+		batch, found := pending[seq]
+		for !found {
+			next, ok := <-sent
+			if !ok {
+				break
+			}
+			pending[next.seq] = next
+			batch, found = pending[seq]
+		}
+		return batch, found
+	}
+
+	for {
+		if len(pending) == 0 {
+			batch, ok := <-sent
+			if !ok {
+				return
+			}
+			pending[batch.seq] = batch
+		}
+
+		ack, err := proto.WaitConfirmation(ctx)
+		if err != nil {
+			// The batch is attached to errors referring to it, so the
+			// rejected bets can be traced back to the csv
+			result := ackResult{err: err}
+			var serverErr *ServerError
+			if errors.As(err, &serverErr) && serverErr.HasSeq {
+				result.batch, _ = lookup(serverErr.Seq)
+			}
+			acks <- result
+			return
+		}
+
+		batch, found := lookup(ack.Seq)
+
+		if !found {
+			acks <- ackResult{err: fmt.Errorf("unexpected acknowledgement for batch %d", ack.Seq)}
+			return
+		}
+
+		delete(pending, ack.Seq)
+		acks <- ackResult{batch: batch, alreadyStored: ack.AlreadyStored, latency: time.Since(batch.sentAt)}
+	}
+}
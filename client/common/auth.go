@@ -0,0 +1,51 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// size of the random challenge sent by the server and of the HMAC-SHA256
+// the agency answers with
+const _AUTH_NONCE_SIZE = 32
+const _AUTH_MAC_SIZE = sha256.Size
+
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// LoadAgencySecret Reads the secret shared between the agency and the server
+// from the given file, ignoring surrounding whitespace such as a trailing
+// newline. Returns nil if path is empty, meaning the agency has no secret
+func LoadAgencySecret(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read agency secret: %w", err)
+	}
+
+	secret := bytes.TrimSpace(content)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("agency secret file %v is empty", path)
+	}
+	return secret, nil
+}
+
+// authResponse Computes the answer to the challenge of the server, which
+// proves the agency knows its secret without sending it. The agency id is
+// included so the answer cannot be used to authenticate as another agency
+func authResponse(secret []byte, nonce []byte, agencyId uint32) []byte {
+	agency := make([]byte, 4)
+	binary.BigEndian.PutUint32(agency, agencyId)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write(agency)
+	return mac.Sum(nil)
+}
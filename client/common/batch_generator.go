@@ -1,30 +1,80 @@
 package common
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 )
 
-const _MAX_BATCH_SIZE = 1024 * 8
-
 type BatchGenerator struct {
-	agency    string
 	pendingBet *Bet
-	csvReader  *bufio.Scanner
+	bets       BetSource
+	// records read from bets, valid or not
+	records    int
+	validator  *BetValidator
 	batchAmount int
+	maxBatchSize int
 	betSize     func(b *Bet) int
 }
 
-func NewBatchGenerator(agency string, batchAmount int, csvReader *bufio.Scanner, betSize func(b *Bet) int) *BatchGenerator {
+func NewBatchGenerator(bets BetSource, validator *BetValidator, batchAmount int, maxBatchSize int, betSize func(b *Bet) int) *BatchGenerator {
 	return &BatchGenerator{
-		agency:    agency,
 		pendingBet: nil,
-		csvReader:  csvReader,
+		bets:       bets,
+		validator:  validator,
 		batchAmount: batchAmount,
+		maxBatchSize: maxBatchSize,
 		betSize:    betSize,
 	}
 }
 
+// Skip Discards the next records without sending them, so an upload can
+// continue from the record after the last batch stored by the server
+func (bg *BatchGenerator) Skip(records int) error {
+	var rejected *RejectedRow
+	for bg.records < records {
+		if _, err := bg.next(); err == io.EOF {
+			return fmt.Errorf("bets source has %d records, can not skip %d", bg.records, records)
+		} else if err != nil && !errors.As(err, &rejected) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordsRead Returns the amount of records read from the source, valid or
+// not
+func (bg *BatchGenerator) RecordsRead() int {
+	return bg.records
+}
+
+// RecordsConsumed Returns the amount of records whose bets were already
+// returned in a batch
+func (bg *BatchGenerator) RecordsConsumed() int {
+	if bg.pendingBet != nil {
+		return bg.records - 1
+	}
+	return bg.records
+}
+
+// next Reads the next record of the source, counting it
+func (bg *BatchGenerator) next() (*Bet, error) {
+	bet, err := bg.bets.Next()
+	var rejected *RejectedRow
+	if bet != nil || errors.As(err, &rejected) {
+		bg.records++
+	}
+	return bet, err
+}
+
+// raw Returns how the bet looks in its source
+func (bg *BatchGenerator) raw(bet *Bet) string {
+	if source, ok := bg.bets.(RawBetSource); ok {
+		return source.Raw()
+	}
+	return rawBet(bet)
+}
+
 func (bg *BatchGenerator) GetNextBatch() ([]*Bet, error) {
 	batch := make([]*Bet, 0)
 	serializedSize := 0
@@ -36,17 +86,37 @@ func (bg *BatchGenerator) GetNextBatch() ([]*Bet, error) {
 	}
 
 	for len(batch) < bg.batchAmount {
-		if !bg.csvReader.Scan() {
+		bet, err := bg.next()
+		if err == io.EOF {
 			break
 		}
 
-		line := bg.csvReader.Text()
-		bet := CreateBetFromCSVLine(bg.agency,line)
-		if bet == nil {
-			return nil, fmt.Errorf("error parsing csv line")
+		var rejected *RejectedRow
+		if errors.As(err, &rejected) {
+			if err := bg.validator.Reject(rejected); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
 
-		if bg.betSize(bet) + serializedSize > _MAX_BATCH_SIZE {
+		if reason := bg.validator.Check(bet); reason != nil {
+			rejected := &RejectedRow{File: bet.file, Line: bet.line, Raw: bg.raw(bet), Reason: reason}
+			if err := bg.validator.Reject(rejected); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// A bet that does not fit in an empty batch would be left pending forever
+		if bg.betSize(bet) > bg.maxBatchSize {
+			return nil, fmt.Errorf("bet at line %d takes %d bytes and can never fit in a batch of %d bytes",
+				bet.line, bg.betSize(bet), bg.maxBatchSize)
+		}
+
+		if bg.betSize(bet) + serializedSize > bg.maxBatchSize {
 			bg.pendingBet = bet
 			break
 		} else {
@@ -56,4 +126,4 @@ func (bg *BatchGenerator) GetNextBatch() ([]*Bet, error) {
 	}
 
 	return batch, nil
-}
\ No newline at end of file
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/csv"
 	"strings"
 )
 
@@ -11,19 +12,33 @@ type Bet struct {
 	document string
 	birthday string
 	number string
+	// file and line of the csv the bet was read from, starting from 1
+	file string
+	line int
 }
 
-func CreateBetFromCSVLine(agency string, line string) *Bet {
-	parts := strings.Split(line, ",")
-	if len(parts) < 5 {
-		return nil
-	}
+// newBet Creates a bet from its fields: first name, last name, document,
+// birthdate and number
+func newBet(agency string, fields []string) *Bet {
 	return &Bet{
 		agency:  agency,
-		firstName: parts[0],
-		lastName:  parts[1],
-		document: parts[2],
-		birthday: parts[3],
-		number:   parts[4],
+		firstName: fields[0],
+		lastName:  fields[1],
+		document: fields[2],
+		birthday: fields[3],
+		number:   fields[4],
 	}
-}
\ No newline at end of file
+}
+
+// CreateBetFromCSVLine Parses a bet from a single comma separated line,
+// which may quote its fields. Returns nil if it does not have exactly the
+// fields of a bet
+func CreateBetFromCSVLine(agency string, line string) *Bet {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.FieldsPerRecord = _BET_FIELDS
+	fields, err := reader.Read()
+	if err != nil {
+		return nil
+	}
+	return newBet(agency, fields)
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strings"
+)
+
+// BetSource Provides the bets of an agency, one at a time
+type BetSource interface {
+	// Next Returns the next bet, or io.EOF once there are no more. An entry
+	// that can not be read as a bet is returned as a *RejectedRow error,
+	// after which the following ones can still be read
+	Next() (*Bet, error)
+}
+
+// RawBetSource A BetSource that can tell how the last bet read looks in its
+// input, to report it if it is invalid
+type RawBetSource interface {
+	BetSource
+	Raw() string
+}
+
+// NewBet Creates a bet of the agency from its fields
+func NewBet(agency string, firstName string, lastName string, document string, birthdate string, number string) *Bet {
+	return newBet(agency, []string{firstName, lastName, document, birthdate, number})
+}
+
+// rawBet Returns the fields of the bet as a csv row, for bets read from a
+// source that can not tell how they look in its input
+func rawBet(bet *Bet) string {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{bet.firstName, bet.lastName, bet.document, bet.birthday, bet.number})
+	writer.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// MemoryBetSource Provides bets held in memory, numbering them from 1 as if
+// each were a line of a file
+type MemoryBetSource struct {
+	bets []*Bet
+	next int
+}
+
+// NewMemoryBetSource Creates a source of the given bets, in order
+func NewMemoryBetSource(bets ...*Bet) *MemoryBetSource {
+	return &MemoryBetSource{bets: bets}
+}
+
+// Next Returns a copy of the next bet, so the source can be read again
+func (s *MemoryBetSource) Next() (*Bet, error) {
+	if s.next == len(s.bets) {
+		return nil, io.EOF
+	}
+
+	bet := *s.bets[s.next]
+	s.next++
+	bet.file, bet.line = "memory", s.next
+	return &bet, nil
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// layout of the birthdate of the bets, as the server parses it
+const _BIRTHDATE_LAYOUT = "2006-01-02"
+
+// ValidationRules Bounds a bet must respect to be sent to the server
+type ValidationRules struct {
+	MinBirthdate time.Time
+	MaxBirthdate time.Time
+	MinDocument  uint64
+	MaxDocument  uint64
+	MinNumber    uint64
+	MaxNumber    uint64
+	// MaxFieldLength is the maximum amount of characters of every field
+	MaxFieldLength int
+}
+
+// DefaultValidationRules Returns rules that accept every bet of the sample
+// agency files: people born since 1900 and until today, documents of up to 8
+// digits and numbers of up to 4 digits
+func DefaultValidationRules() ValidationRules {
+	return ValidationRules{
+		MinBirthdate:   time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC),
+		MaxBirthdate:   time.Now().UTC().Truncate(24 * time.Hour),
+		MinDocument:    1,
+		MaxDocument:    99999999,
+		MinNumber:      0,
+		MaxNumber:      9999,
+		MaxFieldLength: 100,
+	}
+}
+
+// Validate Checks the fields of the bet, returning an error describing the
+// first one that does not respect the rules
+func (b *Bet) Validate(rules ValidationRules) error {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"first name", b.firstName},
+		{"last name", b.lastName},
+		{"document", b.document},
+		{"birthdate", b.birthday},
+		{"number", b.number},
+	}
+	for _, field := range fields {
+		if strings.TrimSpace(field.value) == "" {
+			return fmt.Errorf("%v is empty", field.name)
+		}
+		if !utf8.ValidString(field.value) {
+			return fmt.Errorf("%v is not valid UTF-8", field.name)
+		}
+		if length := utf8.RuneCountInString(field.value); length > rules.MaxFieldLength {
+			return fmt.Errorf("%v has %d characters, more than the %d allowed", field.name, length, rules.MaxFieldLength)
+		}
+	}
+
+	if err := validateNumber("document", b.document, rules.MinDocument, rules.MaxDocument); err != nil {
+		return err
+	}
+	if err := validateNumber("number", b.number, rules.MinNumber, rules.MaxNumber); err != nil {
+		return err
+	}
+
+	birthdate, err := time.Parse(_BIRTHDATE_LAYOUT, b.birthday)
+	if err != nil || len(b.birthday) != len(_BIRTHDATE_LAYOUT) {
+		return fmt.Errorf("birthdate %q is not a valid YYYY-MM-DD date", b.birthday)
+	}
+	if birthdate.Before(rules.MinBirthdate) || birthdate.After(rules.MaxBirthdate) {
+		return fmt.Errorf("birthdate %v is not between %v and %v",
+			b.birthday, rules.MinBirthdate.Format(_BIRTHDATE_LAYOUT), rules.MaxBirthdate.Format(_BIRTHDATE_LAYOUT))
+	}
+	return nil
+}
+
+// validateNumber Checks the field is a non negative integer within bounds
+func validateNumber(name string, value string, min uint64, max uint64) error {
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%v %q is not a non negative integer", name, value)
+	}
+	if number < min || number > max {
+		return fmt.Errorf("%v %v is not between %v and %v", name, number, min, max)
+	}
+	return nil
+}
+
+// ValidationMode What to do with the bets that do not respect the rules
+type ValidationMode int
+
+const (
+	// ValidationStrict stops the upload at the first invalid row
+	ValidationStrict ValidationMode = iota
+	// ValidationSkip drops the invalid rows, logging them
+	ValidationSkip
+	// ValidationQuarantine drops the invalid bets, writing their line,
+	// raw content and the reason to a quarantine csv so they can be fixed
+	// and uploaded later
+	ValidationQuarantine
+)
+
+// ParseValidationMode Parses the name of a validation mode
+func ParseValidationMode(name string) (ValidationMode, error) {
+	switch name {
+	case "strict":
+		return ValidationStrict, nil
+	case "skip":
+		return ValidationSkip, nil
+	case "quarantine":
+		return ValidationQuarantine, nil
+	default:
+		return 0, fmt.Errorf("unknown validation mode %q, it must be strict, skip or quarantine", name)
+	}
+}
+
+func (mode ValidationMode) String() string {
+	switch mode {
+	case ValidationSkip:
+		return "skip"
+	case ValidationQuarantine:
+		return "quarantine"
+	default:
+		return "strict"
+	}
+}
+
+// ErrTooManyRejects is wrapped by the error returned when the ratio of rows
+// rejected exceeds the maximum allowed
+var ErrTooManyRejects = errors.New("too many rejected rows")
+
+// BetValidator Validates the bets before they are sent, handling the rows
+// rejected according to its mode. A nil *BetValidator accepts every bet and
+// rejects no row
+type BetValidator struct {
+	agency         string
+	rules          ValidationRules
+	mode           ValidationMode
+	maxRejectRatio float64
+	quarantine     *csv.Writer
+	rejected       int
+	// line of the last row rejected of each file. The rows after a resumed
+	// upload are read again, possibly from several files, and the ones
+	// already rejected are not reported twice
+	lastRejectedLines map[string]int
+}
+
+// NewBetValidator Creates a validator. In quarantine mode the rejected rows
+// are written as csv to quarantine, after a header row. If quarantine is a
+// file that is not empty, as when a resumed upload appends to it, the header
+// is not written again. A ratio of rejected rows above maxRejectRatio fails
+// the upload
+func NewBetValidator(agency string, rules ValidationRules, mode ValidationMode, quarantine io.Writer, maxRejectRatio float64) (*BetValidator, error) {
+	validator := &BetValidator{
+		agency:            agency,
+		rules:             rules,
+		mode:              mode,
+		maxRejectRatio:    maxRejectRatio,
+		lastRejectedLines: make(map[string]int),
+	}
+	if mode == ValidationQuarantine {
+		validator.quarantine = csv.NewWriter(quarantine)
+		if file, ok := quarantine.(interface{ Stat() (os.FileInfo, error) }); ok {
+			if info, err := file.Stat(); err != nil {
+				return nil, err
+			} else if info.Size() > 0 {
+				return validator, nil
+			}
+		}
+		if err := validator.writeQuarantine([]string{"file", "line", "raw", "reason"}); err != nil {
+			return nil, err
+		}
+	}
+	return validator, nil
+}
+
+// Check Returns why the bet is invalid, or nil if it can be sent
+func (v *BetValidator) Check(bet *Bet) error {
+	if v == nil {
+		return nil
+	}
+	return bet.Validate(v.rules)
+}
+
+// Reject Handles a row that can not be sent. It is returned as an error in
+// strict mode, and otherwise it is dropped
+func (v *BetValidator) Reject(row *RejectedRow) error {
+	if v == nil || v.mode == ValidationStrict {
+		return row
+	}
+	if line, found := v.lastRejectedLines[row.File]; found && row.Line <= line {
+		return nil
+	}
+	v.lastRejectedLines[row.File] = row.Line
+	v.rejected++
+
+	result := "skipped"
+	if v.mode == ValidationQuarantine {
+		result = "quarantined"
+	}
+	log.Warningf("action: validar_apuesta | result: %v | client_id: %v | file: %v | line: %v | error: %v",
+		result,
+		v.agency,
+		row.File,
+		row.Line,
+		row.Reason,
+	)
+
+	if v.quarantine == nil {
+		return nil
+	}
+	if err := v.writeQuarantine([]string{row.File, strconv.Itoa(row.Line), row.Raw, row.Reason.Error()}); err != nil {
+		return fmt.Errorf("could not quarantine %v line %d: %w", row.File, row.Line, err)
+	}
+	return nil
+}
+
+func (v *BetValidator) writeQuarantine(record []string) error {
+	v.quarantine.Write(record)
+	v.quarantine.Flush()
+	return v.quarantine.Error()
+}
+
+// RestoreRejected Counts the rows rejected before the records skipped by a
+// resumed upload, which are not read again
+func (v *BetValidator) RestoreRejected(rejected int) {
+	if v != nil && rejected > v.rejected {
+		v.rejected = rejected
+	}
+}
+
+// CheckRejectRatio Fails if the rows rejected are more than allowed among
+// the given amount of rows read
+func (v *BetValidator) CheckRejectRatio(records int) error {
+	if v == nil || records == 0 {
+		return nil
+	}
+
+	ratio := float64(v.rejected) / float64(records)
+	if ratio > v.maxRejectRatio {
+		return fmt.Errorf("%w: %d of %d rows, a ratio of %.6g above the %.6g allowed",
+			ErrTooManyRejects, v.rejected, records, ratio, v.maxRejectRatio)
+	}
+	return nil
+}
+
+// Rejected Returns the amount of rows dropped
+func (v *BetValidator) Rejected() int {
+	if v == nil {
+		return 0
+	}
+	return v.rejected
+}
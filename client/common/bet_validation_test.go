@@ -0,0 +1,142 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validBet() *Bet {
+	return &Bet{agency: "1", firstName: "Santiago Lionel", lastName: "Lorca", document: "30904465", birthday: "1999-03-17", number: "7574", line: 1}
+}
+
+func TestBetValidate(t *testing.T) {
+	rules := DefaultValidationRules()
+	rules.MaxBirthdate = time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		modify func(b *Bet)
+		valid  bool
+	}{
+		{"valid", func(b *Bet) {}, true},
+		{"lowest bounds", func(b *Bet) { b.document, b.number, b.birthday = "1", "0", "1900-01-01" }, true},
+		{"highest bounds", func(b *Bet) { b.document, b.number, b.birthday = "99999999", "9999", "2020-12-31" }, true},
+		{"empty first name", func(b *Bet) { b.firstName = "" }, false},
+		{"blank last name", func(b *Bet) { b.lastName = "  " }, false},
+		{"name too long", func(b *Bet) { b.firstName = strings.Repeat("a", 101) }, false},
+		{"long name of multibyte characters", func(b *Bet) { b.firstName = strings.Repeat("ñ", 100) }, true},
+		{"invalid UTF-8", func(b *Bet) { b.lastName = "\xff" }, false},
+		{"non numeric document", func(b *Bet) { b.document = "30.904.465" }, false},
+		{"negative document", func(b *Bet) { b.document = "-1" }, false},
+		{"document out of bounds", func(b *Bet) { b.document = "100000000" }, false},
+		{"zero document", func(b *Bet) { b.document = "0" }, false},
+		{"non integer number", func(b *Bet) { b.number = "7574.5" }, false},
+		{"number out of bounds", func(b *Bet) { b.number = "10000" }, false},
+		{"nonexistent date", func(b *Bet) { b.birthday = "1999-02-30" }, false},
+		{"date without padding", func(b *Bet) { b.birthday = "1999-3-17" }, false},
+		{"date in another format", func(b *Bet) { b.birthday = "17/03/1999" }, false},
+		{"date too old", func(b *Bet) { b.birthday = "1899-12-31" }, false},
+		{"date in the future", func(b *Bet) { b.birthday = "2021-01-01" }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bet := validBet()
+			test.modify(bet)
+			if err := bet.Validate(rules); (err == nil) != test.valid {
+				t.Fatalf("expected valid: %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestBetValidatorModes(t *testing.T) {
+	row := &RejectedRow{File: "agency.csv", Line: 2, Raw: "Santiago,\"Lorca\",abc,1999-03-17,7574", Reason: errors.New("document \"abc\" is not a non negative integer")}
+
+	strict, err := NewBetValidator("1", DefaultValidationRules(), ValidationStrict, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := strict.Check(validBet()); err != nil {
+		t.Fatalf("expected a valid bet to be accepted, got %v", err)
+	}
+	if err := strict.Reject(row); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected strict mode to fail on the rejected row, got %v", err)
+	}
+
+	skip, err := NewBetValidator("1", DefaultValidationRules(), ValidationSkip, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := skip.Reject(row); err != nil || skip.Rejected() != 1 {
+		t.Fatalf("expected skip mode to drop the row, got %v", err)
+	}
+
+	quarantine := &bytes.Buffer{}
+	validator, err := NewBetValidator("1", DefaultValidationRules(), ValidationQuarantine, quarantine, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// A resumed upload reads the row again
+		if err := validator.Reject(row); err != nil {
+			t.Fatalf("expected quarantine mode to drop the row, got %v", err)
+		}
+	}
+
+	expected := "file,line,raw,reason\n" +
+		"agency.csv,2,\"Santiago,\"\"Lorca\"\",abc,1999-03-17,7574\",\"document \"\"abc\"\" is not a non negative integer\"\n"
+	if quarantine.String() != expected || validator.Rejected() != 1 {
+		t.Fatalf("expected the row to be quarantined once, got %q and %d rejected", quarantine.String(), validator.Rejected())
+	}
+}
+
+func TestBetValidatorRejectsRowsOnceAcrossFiles(t *testing.T) {
+	validator, err := NewBetValidator("1", DefaultValidationRules(), ValidationSkip, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []*RejectedRow{
+		{File: "first.csv", Line: 3, Reason: errors.New("invalid")},
+		{File: "first.csv", Line: 7, Reason: errors.New("invalid")},
+		{File: "second.csv", Line: 2, Reason: errors.New("invalid")},
+	}
+	// A resumed upload reads the rows of both files again
+	for i := 0; i < 2; i++ {
+		for _, row := range rows {
+			if err := validator.Reject(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if validator.Rejected() != len(rows) {
+		t.Fatalf("expected every row to be rejected once, got %d rejected", validator.Rejected())
+	}
+}
+
+func TestBetValidatorRejectRatio(t *testing.T) {
+	validator, err := NewBetValidator("1", DefaultValidationRules(), ValidationSkip, nil, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.Reject(&RejectedRow{Line: 1, Reason: errors.New("invalid")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validator.CheckRejectRatio(10); err != nil {
+		t.Fatalf("expected 1 of 10 rows to be allowed, got %v", err)
+	}
+	if err := validator.CheckRejectRatio(9); !errors.Is(err, ErrTooManyRejects) {
+		t.Fatalf("expected 1 of 9 rows to exceed the ratio, got %v", err)
+	}
+
+	var none *BetValidator
+	if err := none.CheckRejectRatio(1); err != nil {
+		t.Fatalf("expected no validator to accept any ratio, got %v", err)
+	}
+}
@@ -0,0 +1,380 @@
+package common
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// _STDIN is how the standard input is named in the list of bets files
+const _STDIN = "-"
+
+// formats the bets files can be in
+const FormatCSV = "csv"
+const FormatJSONL = "jsonl"
+
+// separates an archive from the pattern of the members read from it
+const _ZIP_MEMBER_SEPARATOR = "#"
+
+// BetsInput The files the bets of the agency are read from, one after the
+// other. Files ending in .gz are decompressed, and every member of a .zip is
+// read as a file, in the order they are stored
+type BetsInput struct {
+	spec  string
+	files []string
+	// stdin holds a copy of the standard input, which can only be read once,
+	// so the bets can be read again if the upload is retried
+	stdin string
+}
+
+// NewBetsInput Expands the comma separated list of files in spec. Each of
+// them may be a glob, "-" for the standard input, or a .zip optionally
+// followed by "#" and a pattern the members read must match, as in
+// "dataset.zip#agency-1.csv"
+func NewBetsInput(spec string) (*BetsInput, error) {
+	input := &BetsInput{spec: spec}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if entry == _STDIN {
+			if input.stdin == "" {
+				if err := input.copyStdin(); err != nil {
+					input.Close()
+					return nil, err
+				}
+			}
+			input.files = append(input.files, entry)
+			continue
+		}
+
+		files, err := expandEntry(entry)
+		if err != nil {
+			input.Close()
+			return nil, err
+		}
+		input.files = append(input.files, files...)
+	}
+
+	if len(input.files) == 0 {
+		return nil, fmt.Errorf("no bets files in %q", spec)
+	}
+	return input, nil
+}
+
+// expandEntry Returns the files matching a glob. Archives are expanded to
+// their members
+func expandEntry(entry string) ([]string, error) {
+	archivePattern, memberPattern := entry, ""
+	if i := strings.Index(entry, _ZIP_MEMBER_SEPARATOR); i >= 0 && isZip(entry[:i]) {
+		archivePattern, memberPattern = entry[:i], entry[i+1:]
+	}
+
+	matches, err := filepath.Glob(archivePattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bets file pattern %q: %w", entry, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no bets file matches %q", entry)
+	}
+
+	files := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if !isZip(match) {
+			files = append(files, match)
+			continue
+		}
+
+		members, err := zipMembers(match, memberPattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, members...)
+	}
+	return files, nil
+}
+
+// zipMembers Returns the files of the archive matching pattern, or all of
+// them if it is empty, named as archive#member
+func zipMembers(archive string, pattern string) ([]string, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("could not open bets archive %v: %w", archive, err)
+	}
+	defer reader.Close()
+
+	members := make([]string, 0)
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if pattern != "" {
+			if matched, err := path.Match(pattern, file.Name); err != nil {
+				return nil, fmt.Errorf("invalid bets archive member pattern %q: %w", pattern, err)
+			} else if !matched {
+				continue
+			}
+		}
+		members = append(members, archive+_ZIP_MEMBER_SEPARATOR+file.Name)
+	}
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no member of bets archive %v matches %q", archive, pattern)
+	}
+	return members, nil
+}
+
+func isZip(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// copyStdin Copies the standard input to a temporary file
+func (in *BetsInput) copyStdin() error {
+	file, err := ioutil.TempFile("", "bets-stdin-*.csv")
+	if err != nil {
+		return fmt.Errorf("could not copy bets from stdin: %w", err)
+	}
+	in.stdin = file.Name()
+
+	_, err = io.Copy(file, os.Stdin)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not copy bets from stdin: %w", err)
+	}
+	return nil
+}
+
+// String Returns the list of files as configured, which identifies the
+// input of a persisted upload
+func (in *BetsInput) String() string {
+	return in.spec
+}
+
+// Fingerprint Returns a digest of the size and modification time of every
+// file, which changes if any of them is edited or replaced. Members of an
+// archive are covered by the archive
+func (in *BetsInput) Fingerprint() (string, error) {
+	digest := sha256.New()
+	for _, name := range in.files {
+		file := name
+		if i := strings.Index(name, _ZIP_MEMBER_SEPARATOR); i >= 0 && isZip(name[:i]) {
+			file = name[:i]
+		} else if name == _STDIN {
+			file = in.stdin
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(digest, "%v\x00%d\x00%d\n", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// ReadsStdin Returns whether the standard input is among the files, whose
+// content may be different every time the client runs
+func (in *BetsInput) ReadsStdin() bool {
+	return in.stdin != ""
+}
+
+// Close Removes the copy of the standard input
+func (in *BetsInput) Close() error {
+	if in.stdin == "" {
+		return nil
+	}
+	return os.Remove(in.stdin)
+}
+
+// Open Returns a reader of the bets of the agency in every file, in the
+// given format or, if empty, the one their extension tells. The csv files are
+// parsed with the given options
+func (in *BetsInput) Open(agency string, format string, options CSVOptions) *BetFilesReader {
+	return &BetFilesReader{input: in, agency: agency, format: format, options: options}
+}
+
+// formatOf Returns the format of the file: jsonl if its name ends in .jsonl
+// or .ndjson, even if gzipped, and csv otherwise
+func formatOf(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".gz")
+	if strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".ndjson") {
+		return FormatJSONL
+	}
+	return FormatCSV
+}
+
+// open Opens one of the files, decompressing it if needed
+func (in *BetsInput) open(name string) (io.ReadCloser, error) {
+	if name == _STDIN {
+		return os.Open(in.stdin)
+	}
+
+	if i := strings.Index(name, _ZIP_MEMBER_SEPARATOR); i >= 0 && isZip(name[:i]) {
+		return openZipMember(name[:i], name[i+1:])
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(filepath.Ext(name), ".gz") {
+		return file, nil
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("invalid gzip file %v: %w", name, err)
+	}
+	return &multiCloser{Reader: reader, closers: []io.Closer{reader, file}}, nil
+}
+
+func openZipMember(archive string, member string) (io.ReadCloser, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range reader.File {
+		if file.Name != member {
+			continue
+		}
+		content, err := file.Open()
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		return &multiCloser{Reader: content, closers: []io.Closer{content, reader}}, nil
+	}
+
+	reader.Close()
+	return nil, fmt.Errorf("bets archive %v has no member %v", archive, member)
+}
+
+// multiCloser Closes every resource a reader depends on
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	var err error
+	for _, closer := range m.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// BetFilesReader Reads the bets of every file of the input, one after the
+// other. Each file is parsed on its own, so it may have its own header row,
+// and lines are numbered from the start of each file
+type BetFilesReader struct {
+	input   *BetsInput
+	agency  string
+	format  string
+	options CSVOptions
+	// index of the file being read, and its reader
+	index   int
+	name    string
+	file    io.ReadCloser
+	current RawBetSource
+}
+
+// Next Returns the next bet, or io.EOF once every file was read. A row that
+// can not be parsed is returned as a *RejectedRow error
+func (r *BetFilesReader) Next() (*Bet, error) {
+	for {
+		if r.current == nil {
+			if r.index == len(r.input.files) {
+				return nil, io.EOF
+			}
+			if err := r.openNext(); err != nil {
+				return nil, err
+			}
+		}
+
+		bet, err := r.current.Next()
+		if err == io.EOF {
+			r.closeCurrent()
+			continue
+		}
+
+		var rejected *RejectedRow
+		if errors.As(err, &rejected) {
+			rejected.File = r.name
+		}
+		if bet != nil {
+			bet.file = r.name
+		}
+		return bet, err
+	}
+}
+
+func (r *BetFilesReader) openNext() error {
+	name := r.input.files[r.index]
+	r.index++
+
+	file, err := r.input.open(name)
+	if err != nil {
+		return fmt.Errorf("could not open bets file: %w", err)
+	}
+
+	format := r.format
+	if format == "" {
+		format = formatOf(name)
+	}
+
+	var reader RawBetSource
+	if format == FormatJSONL {
+		reader = NewJSONLBetReader(r.agency, file)
+	} else {
+		reader, err = NewCSVBetReader(r.agency, file, r.options)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("invalid bets file %v: %w", name, err)
+		}
+	}
+
+	r.name, r.file, r.current = name, file, reader
+	if name == _STDIN {
+		r.name = "stdin"
+	}
+	return nil
+}
+
+func (r *BetFilesReader) closeCurrent() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file, r.current = nil, nil
+}
+
+// Raw Returns the text of the last record read, as it is in its file
+func (r *BetFilesReader) Raw() string {
+	if r.current == nil {
+		return ""
+	}
+	return r.current.Raw()
+}
+
+// Close Closes the file being read
+func (r *BetFilesReader) Close() error {
+	r.closeCurrent()
+	return nil
+}
@@ -0,0 +1,210 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// writeGzip Writes the content gzipped to name in dir
+func writeGzip(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(content))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, dir, name, buf.Bytes())
+}
+
+// writeZip Writes an archive with the given members, in order
+func writeZip(t *testing.T, dir string, name string, members [][2]string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, member := range members {
+		file, err := writer.Create(member[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(member[1]))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, dir, name, buf.Bytes())
+}
+
+// readPositions Returns where every bet of the input was read from
+func readPositions(t *testing.T, reader *BetFilesReader) []betPosition {
+	t.Helper()
+
+	positions := make([]betPosition, 0)
+	for {
+		bet, err := reader.Next()
+		if err == io.EOF {
+			return positions
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions = append(positions, betPosition{file: bet.file, line: bet.line})
+	}
+}
+
+func TestBetsInputReadsEveryFile(t *testing.T) {
+	dir := t.TempDir()
+	first := writeFile(t, dir, "agency-1.csv", []byte("a,b,1,2000-01-01,1\nc,d,2,2000-01-01,2"))
+	second := writeGzip(t, dir, "agency-2.csv.gz", "e,f,3,2000-01-01,3\n")
+	archive := writeZip(t, dir, "dataset.zip", [][2]string{
+		{"agency-3.csv", "g,h,4,2000-01-01,4\n"},
+		{"readme.txt", "not bets"},
+		{"agency-4.csv", "i,j,5,2000-01-01,5\nk,l,6,2000-01-01,6\n"},
+	})
+
+	input, err := NewBetsInput(filepath.Join(dir, "agency-*.csv*") + ", " + archive + "#agency-*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+
+	reader := input.Open("1", "", DefaultCSVOptions())
+	defer reader.Close()
+
+	expected := []betPosition{
+		{first, 1}, {first, 2},
+		{second, 1},
+		{archive + "#agency-3.csv", 1},
+		{archive + "#agency-4.csv", 1}, {archive + "#agency-4.csv", 2},
+	}
+	positions := readPositions(t, reader)
+	if len(positions) != len(expected) {
+		t.Fatalf("expected bets at %v, got %v", expected, positions)
+	}
+	for i := range expected {
+		if positions[i] != expected[i] {
+			t.Fatalf("expected bets at %v, got %v", expected, positions)
+		}
+	}
+}
+
+func TestBetsInputHeaderOfEachFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.csv", []byte("first_name,last_name,document,birthdate,number\na,b,1,2000-01-01,1\n"))
+	writeFile(t, dir, "b.csv", []byte("number,birthdate,document,last_name,first_name\n2,2000-01-01,2,d,c\n"))
+
+	input, err := NewBetsInput(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultCSVOptions()
+	options.Header = true
+	reader := input.Open("1", "", options)
+	defer reader.Close()
+
+	positions := readPositions(t, reader)
+	if len(positions) != 2 || positions[0].line != 2 || positions[1].line != 2 {
+		t.Fatalf("expected a bet at line 2 of each file, got %v", positions)
+	}
+}
+
+func TestBetsInputFormatOfEachFile(t *testing.T) {
+	dir := t.TempDir()
+	csv := writeFile(t, dir, "a.csv", []byte("a,b,1,2000-01-01,1\n"))
+	jsonl := writeGzip(t, dir, "b.JSONL.gz", "\n{\"first_name\":\"c\",\"last_name\":\"d\",\"document\":2,\"birthdate\":\"2000-01-01\",\"number\":2}\n")
+
+	input, err := NewBetsInput(csv + "," + jsonl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := input.Open("1", "", DefaultCSVOptions())
+	defer reader.Close()
+
+	positions := readPositions(t, reader)
+	expected := []betPosition{{csv, 1}, {jsonl, 2}}
+	if len(positions) != 2 || positions[0] != expected[0] || positions[1] != expected[1] {
+		t.Fatalf("expected bets at %v, got %v", expected, positions)
+	}
+
+	// A forced format applies to every file
+	forced := input.Open("1", FormatJSONL, DefaultCSVOptions())
+	defer forced.Close()
+	var rejected *RejectedRow
+	if _, err := forced.Next(); !errors.As(err, &rejected) || rejected.File != csv {
+		t.Fatalf("expected the csv row to be rejected as JSON, got %v", err)
+	}
+}
+
+func TestBatchGeneratorSkipsRecordsAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := writeFile(t, dir, "a.csv", []byte("a,b,1,2000-01-01,1\n\"c\nd\",e,2,2000-01-01,2\n"))
+	second := writeFile(t, dir, "b.csv", []byte("bad\nf,g,3,2000-01-01,3\n"))
+
+	input, err := NewBetsInput(first + "," + second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := input.Open("1", "", DefaultCSVOptions())
+	defer reader.Close()
+	generator := NewBatchGenerator(reader, nil, 10, 1000, func(b *Bet) int { return 1 })
+
+	// The rejected row counts as a record
+	if err := generator.Skip(3); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := generator.GetNextBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 1 || batch[0].file != second || batch[0].line != 2 {
+		t.Fatalf("expected the bet at line 2 of %v, got %v", second, batch)
+	}
+	if generator.RecordsRead() != 4 {
+		t.Fatalf("expected 4 records read, got %d", generator.RecordsRead())
+	}
+
+	if err := generator.Skip(10); err == nil {
+		t.Fatal("expected skipping past the last file to fail")
+	}
+}
+
+func TestNewBetsInputRejectsMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeZip(t, dir, "dataset.zip", [][2]string{{"agency-1.csv", ""}})
+
+	for _, spec := range []string{"", filepath.Join(dir, "*.csv"), archive + "#agency-9.csv", filepath.Join(dir, "missing.zip")} {
+		if input, err := NewBetsInput(spec); err == nil {
+			input.Close()
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestBetsInputFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	name := writeFile(t, dir, "agency-1.csv", []byte("Santiago,Lorca,30000001,1999-03-17,7574\n"))
+	input, err := NewBetsInput(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := input.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := input.Fingerprint(); err != nil || again != before {
+		t.Fatalf("expected the same fingerprint for unchanged files, got %v and %v", again, err)
+	}
+
+	writeFile(t, dir, "agency-1.csv", []byte("Santiago,Lorca,30000001,1999-03-17,75\n"))
+	if after, err := input.Fingerprint(); err != nil || after == before {
+		t.Fatalf("expected the fingerprint of an edited file to change, got %v and %v", after, err)
+	}
+}
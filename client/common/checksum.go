@@ -0,0 +1,38 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// when checksums are negotiated, every non empty frame payload ends with the
+// CRC-32 (IEEE, as used by gzip) of the bytes before it
+const _CHECKSUM_SIZE = 4
+
+// ErrChecksumMismatch A frame was corrupted on its way. Sending it again
+// may succeed
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// appendChecksum Returns the payload followed by its checksum
+func appendChecksum(payload []byte) []byte {
+	checksum := make([]byte, _CHECKSUM_SIZE)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(payload))
+	return append(payload, checksum...)
+}
+
+// verifyChecksum Returns the payload without its checksum, or an error
+// wrapping ErrChecksumMismatch if the checksum does not match it
+func verifyChecksum(payload []byte) ([]byte, error) {
+	if len(payload) < _CHECKSUM_SIZE {
+		return nil, fmt.Errorf("%w: frame of %d bytes can not hold a checksum", ErrChecksumMismatch, len(payload))
+	}
+
+	data := payload[:len(payload)-_CHECKSUM_SIZE]
+	expected := binary.BigEndian.Uint32(payload[len(data):])
+	if actual := crc32.ChecksumIEEE(data); actual != expected {
+		return nil, fmt.Errorf("%w: expected %08x, got %08x", ErrChecksumMismatch, expected, actual)
+	}
+	return data, nil
+}
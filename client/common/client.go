@@ -1,7 +1,13 @@
 package common
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"time"
@@ -10,157 +16,749 @@ import (
 )
 
 var log = logging.MustGetLogger("log")
-const _SECONDS_TO_REASK = 1
+
+// ErrWinnersNotReady The server did not perform the raffle before the attempts
+// of the retry policy ran out
+var ErrWinnersNotReady = errors.New("winners not ready")
 
 // ClientConfig Configuration used by the client
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
+	// TLS encrypts the connection with the server if not nil
+	TLS           *tls.Config
+	// BetsFiles is the comma separated list of files with the bets of the
+	// agency, as accepted by NewBetsInput
+	BetsFiles string
+	// BetsFormat is the format of every bets file, FormatCSV or FormatJSONL.
+	// If empty it is told by the extension of each file
+	BetsFormat string
+	// OpenBets replaces the bets files as the source of the bets if not nil.
+	// It is called on every upload attempt, which must read the same bets
+	OpenBets func() (BetSource, error)
+	// CSV is the layout of the csv with the bets of the agency
+	CSV           CSVOptions
+	// Bets not respecting ValidationRules are handled according to
+	// ValidationMode, written to QuarantineFile in quarantine mode
+	ValidationRules ValidationRules
+	ValidationMode  ValidationMode
+	QuarantineFile  string
+	// MaxRejectRatio is the fraction of csv rows that can be rejected
+	// without failing the upload
+	MaxRejectRatio float64
 	BatchAmount   int
+	BatchMaxSize  int
+	BatchWindow   int
+	// ThinkTime is waited between consecutive batches, to pace the upload
+	ThinkTime time.Duration
+	// OnBatchAcked is called with every batch the server acknowledges if
+	// not nil
+	OnBatchAcked func(BatchAck)
+	// ResumeStateFile is where the upload progress is persisted. Resuming
+	// uploads is disabled if empty
+	ResumeStateFile  string
+	ResumeMaxRetries int
+	// Retry is used to reconnect to the server and to poll for the winners
+	Retry    RetryPolicy
+	Timeouts Timeouts
+	// Compression is offered to the server to reduce the bytes on the wire
+	Compression bool
+	// AgencySecret authenticates the agency if the server requires it
+	AgencySecret []byte
+	// ShutdownGracePeriod is how long the acknowledgements of the batches in
+	// flight are still awaited once the client is asked to stop
+	ShutdownGracePeriod time.Duration
 }
 
 // Client Entity that encapsulates how
 type Client struct {
-	config ClientConfig
-	proto  *Protocol
-	stopChannel chan struct{}
+	config   ClientConfig
+	agencyId uint32
+	proto    *Protocol
+	rng      *rand.Rand
+	// quarantine holds the rejected rows in quarantine mode
+	quarantine *os.File
+	validator  *BetValidator
+	input      *BetsInput
+	// records read by the last upload attempt
+	recordsRead int
 }
 
 // NewClient Initializes a new client receiving the configuration
 // as a parameter
 func NewClient(config ClientConfig) *Client {
 	client := &Client{
-		config:     config,
-		stopChannel: make(chan struct{}),
-	}
-
-	if err := client.connectToServer(); err != nil {
-		return nil
+		config: config,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 
 	return client
 }
 
-func (c *Client) Start() {
+// Start Connects to the server, sends all the bets of the agency and then
+// waits for its winners. Returns the error that made the client stop, which
+// wraps ErrUnsupportedServerVersion if the server speaks a protocol version
+// the client does not support. Cancelling ctx stops the client: no more
+// batches are sent, and the ones in flight are awaited for up to
+// ShutdownGracePeriod before returning the error of ctx
+func (c *Client) Start(ctx context.Context) error {
 	defer c.cleanup()
 
-	if err := c.sendAllBets(); err != nil {
-		return
+	agencyId, err := c.parseAgencyId()
+	if err != nil {
+		log.Criticalf(
+			"action: parse_agency_id | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
+	}
+	c.agencyId = agencyId
+
+	if c.config.OpenBets == nil {
+		input, err := NewBetsInput(c.config.BetsFiles)
+		if err != nil {
+			log.Criticalf(
+				"action: open_bets | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			return err
+		}
+		c.input = input
+	}
+
+	if err := c.connectWithRetry(ctx); err != nil {
+		return err
+	}
+
+	err = c.sendAllBets(ctx, agencyId)
+	c.logUploadSummary(err)
+	if err != nil {
+		return err
 	}
 
 	c.proto.Close()
 
-	c.waitWinners()
+	return c.waitWinners(ctx, agencyId)
+}
+
+// parseAgencyId Parses the client ID as the agency number used to query
+// the winners, which must be a non negative integer that fits in 32 bits
+func (c *Client) parseAgencyId() (uint32, error) {
+	agencyId, err := strconv.ParseUint(c.config.ID, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid agency id %q: %w", c.config.ID, err)
+	}
+	return uint32(agencyId), nil
+}
+
+// sendAllBets Uploads every bet of the agency. If the connection drops and the
+// upload can be retried safely, it reconnects and sends again the bets not
+// stored by the server, up to ResumeMaxRetries times. That is the case if
+// resuming is enabled or batches are idempotent
+func (c *Client) sendAllBets(ctx context.Context, agencyId uint32) error {
+	state, err := c.loadUploadState()
+	if err != nil {
+		return err
+	}
+
+	if err := c.newBetValidator(state); err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.uploadBets(ctx, agencyId, state)
+		if err == nil {
+			if err := state.Remove(); err != nil {
+				log.Warningf("action: remove_upload_state | result: fail | client_id: %v | error: %v",
+					c.config.ID,
+					err,
+				)
+			}
+			return nil
+		}
+
+		// Saved before retrying or giving up, as acknowledgements are
+		// only saved every few batches
+		if err := state.Flush(); err != nil {
+			log.Warningf("action: save_upload_state | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+		}
+
+		canRetry := c.proto.Idempotent() || (state != nil && c.proto.Resumable())
+		if !canRetry || !isRetryable(err) || attempt > c.config.ResumeMaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		log.Warningf("action: resume_upload | result: in_progress | client_id: %v | attempt: %v | error: %v",
+			c.config.ID,
+			attempt,
+			err,
+		)
+
+		c.proto.Close()
+		if err := c.sleep(ctx, c.config.Retry.Delay(attempt, c.rng)); err != nil {
+			return err
+		}
+
+		if err := c.connectWithRetry(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// loadUploadState Loads the progress of a previous upload, or returns nil if
+// resuming is disabled
+func (c *Client) loadUploadState() (*UploadState, error) {
+	if c.config.ResumeStateFile == "" {
+		return nil, nil
+	}
+
+	if c.input != nil && c.input.ReadsStdin() {
+		log.Warningf("action: load_upload_state | result: skipped | client_id: %v | info: bets read from stdin can not be resumed by another run",
+			c.config.ID,
+		)
+		return nil, nil
+	}
+
+	fingerprint := ""
+	if c.input != nil {
+		var err error
+		if fingerprint, err = c.input.Fingerprint(); err != nil {
+			log.Criticalf("action: load_upload_state | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			return nil, err
+		}
+	}
+
+	state, err := LoadUploadState(c.config.ResumeStateFile, c.config.ID, c.config.BetsFiles, fingerprint)
+	if err != nil {
+		log.Criticalf("action: load_upload_state | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err
+	}
+	return state, nil
+}
+
+// newBetValidator Creates the validator of the bets, opening the quarantine
+// file in quarantine mode. When resuming an upload the rows quarantined
+// before are kept, and the new ones are appended
+func (c *Client) newBetValidator(state *UploadState) error {
+	if c.config.ValidationMode == ValidationQuarantine {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if state.Resuming() {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		quarantine, err := os.OpenFile(c.config.QuarantineFile, flags, 0644)
+		if err != nil {
+			log.Criticalf("action: open_quarantine | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			return err
+		}
+		c.quarantine = quarantine
+	}
+
+	validator, err := NewBetValidator(c.config.ID, c.config.ValidationRules, c.config.ValidationMode, c.quarantine, c.config.MaxRejectRatio)
+	if err != nil {
+		log.Criticalf("action: open_quarantine | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
+	}
+	c.validator = validator
+	return nil
 }
 
-func (c *Client) sendAllBets() error {
-	csvFile, err := os.Open("/agency.csv")
+// logUploadSummary Logs how many csv rows were read, sent and rejected,
+// whether the upload succeeded or not
+func (c *Client) logUploadSummary(err error) {
+	result := "success"
 	if err != nil {
+		result = resultOf(err)
+	}
+
+	rejected := c.validator.Rejected()
+	ratio := 0.0
+	if c.recordsRead > 0 {
+		ratio = float64(rejected) / float64(c.recordsRead)
+	}
+
+	log.Infof("action: resumen_carga | result: %v | client_id: %v | filas: %v | enviadas: %v | rechazadas: %v | ratio_rechazo: %.4f",
+		result,
+		c.config.ID,
+		c.recordsRead,
+		c.recordsRead-rejected,
+		rejected,
+		ratio,
+	)
+}
+
+// uploadBets Sends the bets of the agency through the current connection,
+// starting after the last batch stored by the server if the upload is resumed
+func (c *Client) uploadBets(ctx context.Context, agencyId uint32, state *UploadState) error {
+	if err := c.proto.StartSendingBets(ctx, agencyId, uint32(c.config.BatchMaxSize)); err != nil {
 		log.Criticalf(
-			"action: open_csv | result: fail | client_id: %v | error: %v",
+			"action: start_sending_bets | result: %v | client_id: %v | error: %v",
+			resultOf(err),
 			c.config.ID,
 			err,
 		)
 		return err
 	}
-	defer csvFile.Close()
 
-	csvReader := bufio.NewScanner(csvFile)
-	batchGenerator := NewBatchGenerator(c.config.ID, c.config.BatchAmount, csvReader, c.proto.GetBetSize)
-	
-	if err := c.proto.StartSendingBets(); err != nil {
+	bets, err := c.openBets()
+	if err != nil {
 		log.Criticalf(
-			"action: start_sending_bets | result: fail | client_id: %v | error: %v",
+			"action: open_bets | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
 		return err
 	}
+	if closer, ok := bets.(io.Closer); ok {
+		defer closer.Close()
+	}
+	batchGenerator := NewBatchGenerator(bets, c.validator, c.config.BatchAmount, c.proto.MaxBatchSize(), c.proto.GetBetSize)
+	defer func() { c.recordsRead = batchGenerator.RecordsRead() }()
+
+	c.proto.SetNextSeq(0)
+	if c.proto.Resumable() {
+		completed, err := c.resumeUpload(ctx, state, batchGenerator)
+		if err != nil || completed {
+			return err
+		}
+	}
+
+	// Without pipelining the server expects stop-and-wait
+	window := c.config.BatchWindow
+	if !c.proto.Pipelined() || window < 1 {
+		window = 1
+	}
+
+	// Acknowledgements are still awaited for a while after ctx is cancelled,
+	// so the upload state reflects every batch the server stored
+	ackCtx, cancelAcks := graceContext(ctx, c.config.ShutdownGracePeriod)
+	defer cancelAcks()
+
+	sent := make(chan sentBatch, window)
+	acks := make(chan ackResult, window+1)
+	go readAcks(ackCtx, c.proto, sent, acks)
+
+	inFlight := 0
+	for first := true; ; first = false {
+		if inFlight == window {
+			if err := c.handleAck(acks, state); err != nil {
+				close(sent)
+				return err
+			}
+			inFlight--
+		}
+
+		if c.config.ThinkTime > 0 && !first {
+			if err := c.sleep(ctx, c.config.ThinkTime); err != nil {
+				close(sent)
+				return c.drainAcks(ctx, acks, state, inFlight)
+			}
+		}
 
-	for {
-		sentBets, err := c.generateAndSendBatch(batchGenerator)
+		batch, err := c.generateAndSendBatch(ctx, batchGenerator, state)
+		if err != nil && ctx.Err() != nil {
+			close(sent)
+			return c.drainAcks(ctx, acks, state, inFlight)
+		}
 		if err != nil {
+			close(sent)
+			if isConnectionError(err) {
+				if rejection := c.rejectionInFlight(acks, state, inFlight); rejection != nil {
+					return rejection
+				}
+			}
 			return err
 		}
 
-		if sentBets == 0 {
+		if batch.amount == 0 {
 			// All bets sent
 			break
 		}
 
-		if err := c.proto.WaitConfirmation(); err != nil {
-			log.Errorf("action: wait_confirmation | result: fail | client_id: %v | error: %v",
+		sent <- batch
+		inFlight++
+	}
+
+	close(sent)
+	for ; inFlight > 0; inFlight-- {
+		if err := c.handleAck(acks, state); err != nil {
+			return err
+		}
+	}
+
+	// The upload is left incomplete, so the raffle does not take place
+	// without the bets of the agency
+	if err := c.validator.CheckRejectRatio(batchGenerator.RecordsRead()); err != nil {
+		log.Criticalf("action: check_reject_ratio | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
+	}
+
+	return c.proto.InformCompletion(ctx)
+}
+
+// drainAcks Waits for the acknowledgements of the batches in flight once the
+// client was asked to stop, until the grace period elapses. Returns the error
+// of ctx
+func (c *Client) drainAcks(ctx context.Context, acks <-chan ackResult, state *UploadState, inFlight int) error {
+	log.Infof("action: drain_acks | result: in_progress | client_id: %v | in_flight: %v",
+		c.config.ID,
+		inFlight,
+	)
+
+	for ; inFlight > 0; inFlight-- {
+		if err := c.handleAck(acks, state); err != nil {
+			log.Warningf("action: drain_acks | result: fail | client_id: %v | in_flight: %v",
 				c.config.ID,
-				err,
+				inFlight,
 			)
+			return ctx.Err()
+		}
+	}
+
+	log.Infof("action: drain_acks | result: success | client_id: %v", c.config.ID)
+	return ctx.Err()
+}
+
+// rejectionInFlight Returns the error reported by the server for one of the
+// batches in flight, if any. The server closes the connection after
+// rejecting a batch, so sending the following ones may fail first
+func (c *Client) rejectionInFlight(acks <-chan ackResult, state *UploadState, inFlight int) error {
+	for ; inFlight > 0; inFlight-- {
+		err := c.handleAck(acks, state)
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) {
+			return err
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// resumeUpload Asks the server for the last batch it stored and skips the csv
+// records already sent in it. Without an upload state they are unknown, and
+// if batches are idempotent the upload starts over and the server skips the
+// batches already stored. Returns true if the upload was already completed
+func (c *Client) resumeUpload(ctx context.Context, state *UploadState, batchGenerator *BatchGenerator) (bool, error) {
+	status, err := c.proto.ResumeUpload(ctx)
+	if err != nil {
+		log.Errorf("action: resume_upload | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return false, err
+	}
+
+	if status.Completed {
+		log.Infof("action: resume_upload | result: success | client_id: %v | info: upload already completed",
+			c.config.ID,
+		)
+		return true, nil
+	}
+
+	if !status.HasCommitted {
+		return false, state.Rewind(0, false)
+	}
+
+	if state == nil && !c.proto.Idempotent() {
+		err := fmt.Errorf("server stored batch %d, but there is no upload state to resume from", status.LastCommittedSeq)
+		log.Criticalf("action: resume_upload | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return false, err
+	}
+
+	if state == nil {
+		log.Infof("action: resume_upload | result: success | client_id: %v | info: starting over, stored batches will be skipped",
+			c.config.ID,
+		)
+		return false, nil
+	}
+
+	if err := c.skipStoredBatches(state, batchGenerator, status.LastCommittedSeq); err != nil {
+		log.Criticalf("action: resume_upload | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return false, err
+	}
+
+	if err := state.Rewind(status.LastCommittedSeq, true); err != nil {
+		return false, err
+	}
+
+	c.proto.SetNextSeq(status.LastCommittedSeq + 1)
+	log.Infof("action: resume_upload | result: success | client_id: %v | skipped_records: %v",
+		c.config.ID,
+		batchGenerator.RecordsConsumed(),
+	)
+	return false, nil
+}
+
+// skipStoredBatches Skips the csv records sent up to the batch with the given
+// sequence number. As the upload state is saved every few acknowledgements,
+// the server may have stored batches the state does not know. Those are
+// generated again from the last batch the state knows and dropped
+func (c *Client) skipStoredBatches(state *UploadState, batchGenerator *BatchGenerator, lastSeq uint32) error {
+	records, rejected, found := state.LineAfter(lastSeq)
+	nextSeq := lastSeq + 1
+	if !found {
+		nextSeq, records, rejected = state.LastSavedBefore(lastSeq)
+	}
+
+	if err := batchGenerator.Skip(records); err != nil {
+		return err
+	}
+	c.validator.RestoreRejected(rejected)
+
+	if found {
+		return nil
+	}
+
+	for seq := nextSeq; seq <= lastSeq; seq++ {
+		batch, err := batchGenerator.GetNextBatch()
+		if err != nil {
 			return err
 		}
+		if len(batch) == 0 {
+			return fmt.Errorf("bets source ended before batch %d, stored by the server", seq)
+		}
+	}
+	state.RecordSent(lastSeq, batchGenerator.RecordsConsumed(), c.validator.Rejected())
+	return nil
+}
+
+// handleAck Waits for the acknowledgement of the oldest batch in flight
+func (c *Client) handleAck(acks <-chan ackResult, state *UploadState) error {
+	ack, ok := <-acks
+	if !ok {
+		ack.err = fmt.Errorf("connection closed while waiting confirmation")
+	}
+
+	var serverErr *ServerError
+	if errors.As(ack.err, &serverErr) && serverErr.BetIndex >= 0 && serverErr.BetIndex < len(ack.batch.positions) {
+		position := ack.batch.positions[serverErr.BetIndex]
+		log.Errorf("action: apuesta_rechazada | result: fail | client_id: %v | file: %v | line: %v | code: %v | error: %v",
+			c.config.ID,
+			position.file,
+			position.line,
+			serverErr.Code,
+			serverErr.Message,
+		)
+		return fmt.Errorf("bet at %v line %d rejected: %w", position.file, position.line, ack.err)
+	}
+
+	if errors.Is(ack.err, ErrChecksumMismatch) {
+		log.Errorf("action: checksum_mismatch | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			ack.err,
+		)
+		return ack.err
+	}
+
+	if ack.err != nil {
+		log.Errorf("action: wait_confirmation | result: %v | client_id: %v | error: %v",
+			resultOf(ack.err),
+			c.config.ID,
+			ack.err,
+		)
+		return ack.err
+	}
+
+	if err := state.RecordAck(ack.batch.seq); err != nil {
+		log.Errorf("action: save_upload_state | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
+	}
+
+	if c.config.OnBatchAcked != nil {
+		c.config.OnBatchAcked(BatchAck{
+			Seq:           ack.batch.seq,
+			Bets:          ack.batch.amount,
+			AlreadyStored: ack.alreadyStored,
+			Latency:       ack.latency,
+		})
+	}
 
-		log.Debugf("action: apuesta_enviada | result: success | cantidad: %v",
-			sentBets,
+	if ack.alreadyStored {
+		log.Debugf("action: apuesta_enviada | result: already_stored | cantidad: %v",
+			ack.batch.amount,
 		)
+		return nil
 	}
 
-	c.proto.InformCompletion()
+	log.Debugf("action: apuesta_enviada | result: success | cantidad: %v",
+		ack.batch.amount,
+	)
 	return nil
 }
 
-func (c *Client) generateAndSendBatch(batchGenerator *BatchGenerator) (int, error) {
+func (c *Client) generateAndSendBatch(ctx context.Context, batchGenerator *BatchGenerator, state *UploadState) (sentBatch, error) {
 	batch, err := batchGenerator.GetNextBatch()
 	if err != nil {
 		log.Errorf("action: read_batch | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
-		return 0, err
+		return sentBatch{}, err
 	}
 
 	if len(batch) == 0 {
-		return 0, nil
+		return sentBatch{}, nil
 	}
 
-	if err := c.proto.SendBatch(batch); err != nil {
-		log.Errorf("action: apuesta_enviada | result: fail | client_id: %v | error: %v",
+	// Recorded before sending, as the server may store the batch even if
+	// the client stops before receiving its acknowledgement
+	state.RecordSent(c.proto.NextSeq(), batchGenerator.RecordsConsumed(), c.validator.Rejected())
+
+	sentAt := time.Now()
+	seq, err := c.proto.SendBatch(ctx, batch)
+	if err != nil {
+		log.Errorf("action: apuesta_enviada | result: %v | client_id: %v | error: %v",
+			resultOf(err),
 			c.config.ID,
 			err,
 		)
-		return 0, err
+		return sentBatch{}, err
 	}
 
-	return len(batch), nil
+	positions := make([]betPosition, len(batch))
+	for i, bet := range batch {
+		positions[i] = betPosition{file: bet.file, line: bet.line}
+	}
+	return sentBatch{seq: seq, amount: len(batch), sentAt: sentAt, positions: positions}, nil
 }
 
-func (c *Client) connectToServer() error {
-	proto, err := NewProtocol(c.config.ServerAddress)
-	if err != nil {
-		log.Criticalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
+// connectWithRetry Connects to the server, retrying according to the retry
+// policy while the server is unreachable. Gives up once ctx is cancelled
+func (c *Client) connectWithRetry(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		err := c.connectToServer(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !isConnectionError(err) || c.config.Retry.Exhausted(attempt) {
+			log.Criticalf(
+				"action: connect | result: %v | client_id: %v | attempt: %v | error: %v",
+				resultOf(err),
+				c.config.ID,
+				attempt,
+				err,
+			)
+			return err
+		}
+
+		delay := c.config.Retry.Delay(attempt, c.rng)
+		log.Warningf("action: connect | result: retrying | client_id: %v | attempt: %v | delay: %v | error: %v",
 			c.config.ID,
+			attempt,
+			delay,
 			err,
 		)
+
+		if err := c.sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) connectToServer(ctx context.Context) error {
+	proto, err := NewProtocol(ctx, c.config.ServerAddress, ProtocolOptions{
+		TLS:         c.config.TLS,
+		Timeouts:    c.config.Timeouts,
+		Compression: c.config.Compression,
+	})
+	if err != nil {
 		return err
 	}
+	log.Debugf("action: handshake | result: success | client_id: %v | version: %d | features: %b",
+		c.config.ID,
+		proto.Version(),
+		proto.Features(),
+	)
+
+	if proto.RequiresAuthentication() {
+		if err := c.authenticate(ctx, proto); err != nil {
+			proto.Close()
+			return err
+		}
+	}
+
 	c.proto = proto
 	return nil
 }
 
-func (c *Client) waitWinners() error {
-	agencyId, _ := strconv.Atoi(c.config.ID)
+// authenticate Proves to the server which agency the client speaks for
+func (c *Client) authenticate(ctx context.Context, proto *Protocol) error {
+	if c.config.AgencySecret == nil {
+		return fmt.Errorf("%w: the server requires it but no agency secret is configured", ErrAuthenticationFailed)
+	}
 
-	for {
-		if err := c.connectToServer(); err != nil {
-			log.Criticalf(
-				"action: connect | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
+	if err := proto.Authenticate(ctx, c.agencyId, c.config.AgencySecret); err != nil {
+		return err
+	}
+
+	log.Debugf("action: authenticate | result: success | client_id: %v", c.config.ID)
+	return nil
+}
+
+// waitWinners Polls the server until the winners of the agency are ready,
+// waiting longer between consecutive polls according to the retry policy.
+// Once the polls reach the attempts of the policy, an error wrapping
+// ErrWinnersNotReady is returned. Winners that arrive corrupted are requested
+// again, up to the attempts of the retry policy
+func (c *Client) waitWinners(ctx context.Context, agencyId uint32) error {
+	mismatches := 0
+	for attempt := 1; ; attempt++ {
+		if err := c.connectWithRetry(ctx); err != nil {
 			return err
 		}
 
-		winners, err := c.proto.RequestResults(agencyId)
-		if err != nil {
+		winners, err := c.proto.RequestResults(ctx, agencyId)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			mismatches++
+		}
+		if errors.Is(err, ErrChecksumMismatch) && !c.config.Retry.Exhausted(mismatches) {
+			log.Warningf("action: checksum_mismatch | result: retrying | client_id: %v | attempt: %v | error: %v",
+				c.config.ID,
+				mismatches,
+				err,
+			)
+		} else if err != nil {
 			log.Criticalf(
-				"action: consulta_ganadores | result: fail | client_id: %v | error: %v",
+				"action: consulta_ganadores | result: %v | client_id: %v | error: %v",
+				resultOf(err),
 				c.config.ID,
 				err,
 			)
@@ -177,22 +775,116 @@ func (c *Client) waitWinners() error {
 
 		c.proto.Close()
 
-		select {
-		case <-c.stopChannel:
-			return nil
-		case <- time.After(_SECONDS_TO_REASK * time.Second):
+		if c.config.Retry.Exhausted(attempt) {
+			err := fmt.Errorf("%w after %d requests", ErrWinnersNotReady, attempt)
+			log.Criticalf("action: consulta_ganadores | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			return err
+		}
+
+		if err := c.sleep(ctx, c.config.Retry.Delay(attempt, c.rng)); err != nil {
+			return err
 		}
 	}
 }
-func (c *Client) Stop() {
-	c.proto.Close()
-	close(c.stopChannel)
-	log.Infof("action: client_stopped | result: success | client_id: %v", c.config.ID)
+
+// sleep Waits for the given delay. Returns the error of ctx if it is
+// cancelled meanwhile
+func (c *Client) sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// openBets Returns the source of the bets of the agency for an upload
+// attempt
+func (c *Client) openBets() (BetSource, error) {
+	if c.config.OpenBets != nil {
+		return c.config.OpenBets()
+	}
+	return c.input.Open(c.config.ID, c.config.BetsFormat, c.config.CSV), nil
 }
 
 func (c *Client) cleanup() {
-	c.proto.Close()
-	log.Infof("action: client_connection_closed | result: success | client_id: %v", c.config.ID)
+	if c.proto != nil {
+		c.proto.Close()
+		log.Infof("action: client_connection_closed | result: success | client_id: %v", c.config.ID)
+	}
+
+	if c.quarantine != nil {
+		c.quarantine.Close()
+	}
+
+	if c.input != nil {
+		c.input.Close()
+	}
 
 	log.Infof("action: client_cleanup | result: success | client_id: %v", c.config.ID)
-}
\ No newline at end of file
+}
+
+// resultOf Returns the result logged for a failed operation, telling apart
+// the server not answering in time and the client being stopped from any
+// other failure
+func resultOf(err error) string {
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return "timeout"
+	}
+	if isContextError(err) {
+		return "cancelled"
+	}
+	return "fail"
+}
+
+// graceContext Returns a context that is cancelled once grace elapses after
+// ctx is done, or when the returned function is called
+func graceContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-graceCtx.Done():
+			return
+		}
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-graceCtx.Done():
+		}
+	}()
+	return graceCtx, cancel
+}
+
+// isRetryable Returns true if the operation that failed with err may succeed
+// if attempted again, because the connection dropped or the data was
+// corrupted on its way
+func isRetryable(err error) bool {
+	return isConnectionError(err) || errors.Is(err, ErrChecksumMismatch)
+}
+
+// isConnectionError Returns true if the error was caused by the connection
+// with the server, instead of the bets, the protocol or the client being
+// stopped
+func isConnectionError(err error) bool {
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return true
+	}
+	if isContextError(err) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,491 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/fakeserver"
+)
+
+// startServer Starts a fake server that is closed when the test finishes
+func startServer(t *testing.T, options fakeserver.Options) *fakeserver.Server {
+	t.Helper()
+
+	server, err := fakeserver.Start(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testBets Returns amount bets of agency 1, every tenth of them a winner
+func testBets(amount int) []*common.Bet {
+	bets := make([]*common.Bet, 0, amount)
+	for i := 1; i <= amount; i++ {
+		number := fmt.Sprint(i)
+		if i%10 == 0 {
+			number = "7574"
+		}
+		bets = append(bets, common.NewBet("1", "Santiago", fmt.Sprintf("Lorca %d", i), fmt.Sprint(30000000+i), "1999-03-17", number))
+	}
+	return bets
+}
+
+// testConfig Returns the configuration of agency 1 uploading the bets to the
+// server in batches of 4, with short delays and timeouts
+func testConfig(address string, bets []*common.Bet) common.ClientConfig {
+	return common.ClientConfig{
+		ID:            "1",
+		ServerAddress: address,
+		OpenBets: func() (common.BetSource, error) {
+			return common.NewMemoryBetSource(bets...), nil
+		},
+		ValidationRules:  common.DefaultValidationRules(),
+		MaxRejectRatio:   1,
+		BatchAmount:      4,
+		BatchMaxSize:     8192,
+		BatchWindow:      3,
+		ResumeMaxRetries: 3,
+		Retry: common.RetryPolicy{
+			InitialDelay: 10 * time.Millisecond,
+			Multiplier:   1,
+			MaxDelay:     10 * time.Millisecond,
+			MaxAttempts:  5,
+		},
+		Timeouts: common.Timeouts{
+			Connect: time.Second,
+			Write:   time.Second,
+			Ack:     time.Second,
+			Results: time.Second,
+		},
+		Compression:         true,
+		ShutdownGracePeriod: time.Second,
+	}
+}
+
+// checkStored Checks the server stored every bet exactly once, in order
+func checkStored(t *testing.T, server *fakeserver.Server, bets []*common.Bet) {
+	t.Helper()
+
+	stored := server.Bets()
+	if len(stored) != len(bets) {
+		t.Fatalf("expected %d bets stored, got %d", len(bets), len(stored))
+	}
+	for i, bet := range stored {
+		if bet.LastName != fmt.Sprintf("Lorca %d", i+1) || bet.Agency != "1" {
+			t.Fatalf("unexpected bet %d stored: %+v", i, bet)
+		}
+	}
+}
+
+func TestClientUploadsBetsAndWaitsForWinners(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Results: func(agency uint32, request int) fakeserver.Fault {
+				return fakeserver.Fault{NotReady: request <= 3}
+			},
+		},
+	})
+	bets := testBets(25)
+
+	if err := common.NewClient(testConfig(server.Addr(), bets)).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStored(t, server, bets)
+	if !server.Completed(1) || !server.Raffled() {
+		t.Fatal("expected the upload to be completed and the raffle performed")
+	}
+	if requests := server.ResultsRequests(1); requests != 4 {
+		t.Fatalf("expected the winners to be requested until ready, got %d requests", requests)
+	}
+	if winners := server.Winners(1); len(winners) != 2 {
+		t.Fatalf("expected 2 winners, got %v", winners)
+	}
+}
+
+func TestClientReportsRejectedBet(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+				if batch.Seq != 1 {
+					return fakeserver.Fault{}
+				}
+				return fakeserver.Fault{Error: &fakeserver.Error{
+					Code:     fakeserver.ErrorInvalidBet,
+					Seq:      batch.Seq,
+					HasSeq:   true,
+					BetIndex: 1,
+					Message:  "Invalid bet: rejected by test",
+				}}
+			},
+		},
+	})
+
+	err := common.NewClient(testConfig(server.Addr(), testBets(25))).Start(context.Background())
+
+	var serverErr *common.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != common.ErrorInvalidBet || serverErr.Seq != 1 || serverErr.BetIndex != 1 {
+		t.Fatalf("expected the invalid bet to be reported, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "memory line 6") {
+		t.Fatalf("expected the error to point to the sixth bet, got %v", err)
+	}
+	if server.Completed(1) {
+		t.Fatal("expected the upload not to be completed")
+	}
+}
+
+func TestClientResumesAfterDisconnects(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault fakeserver.Fault
+	}{
+		{"batch discarded", fakeserver.Fault{Disconnect: true}},
+		{"batch stored but not acknowledged", fakeserver.Fault{DisconnectAfterStore: true}},
+	}
+
+	for _, test := range tests {
+		for _, resumeState := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v with state %v", test.name, resumeState), func(t *testing.T) {
+				var once sync.Once
+				server := startServer(t, fakeserver.Options{
+					Hooks: fakeserver.Hooks{
+						Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+							fault := fakeserver.Fault{}
+							if batch.Seq == 2 {
+								once.Do(func() { fault = test.fault })
+							}
+							return fault
+						},
+					},
+				})
+				bets := testBets(25)
+
+				config := testConfig(server.Addr(), bets)
+				if resumeState {
+					config.ResumeStateFile = filepath.Join(t.TempDir(), "state.json")
+				}
+				if err := common.NewClient(config).Start(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+
+				checkStored(t, server, bets)
+				if server.Connections() < 3 {
+					t.Fatalf("expected the upload to be resumed in a new connection, got %d connections", server.Connections())
+				}
+			})
+		}
+	}
+}
+
+func TestClientResumesAfterPartialFrame(t *testing.T) {
+	for _, resumeState := range []bool{false, true} {
+		t.Run(fmt.Sprintf("with state %v", resumeState), func(t *testing.T) {
+			server := startServer(t, fakeserver.Options{
+				Hooks: fakeserver.Hooks{
+					BatchFrame: func(connection int, position uint32) fakeserver.Fault {
+						if connection == 1 && position == 2 {
+							// The header and the first bytes of the payload
+							return fakeserver.Fault{DisconnectAfterBytes: 8}
+						}
+						return fakeserver.Fault{}
+					},
+				},
+			})
+			bets := testBets(25)
+
+			config := testConfig(server.Addr(), bets)
+			if resumeState {
+				config.ResumeStateFile = filepath.Join(t.TempDir(), "state.json")
+			}
+			if err := common.NewClient(config).Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			checkStored(t, server, bets)
+			if server.Connections() < 3 {
+				t.Fatalf("expected the upload to be resumed in a new connection, got %d connections", server.Connections())
+			}
+		})
+	}
+}
+
+func TestClientKeepsQuarantineWhenRestarted(t *testing.T) {
+	var once sync.Once
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+				fault := fakeserver.Fault{}
+				if batch.Seq == 3 {
+					once.Do(func() { fault = fakeserver.Fault{Disconnect: true} })
+				}
+				return fault
+			},
+		},
+	})
+	bets := testBets(25)
+	bets[2] = common.NewBet("1", "Santiago", "Lorca 3", "30000003", "not a date", "3")
+	bets[5] = common.NewBet("1", "Santiago", "Lorca 6", "30000006", "not a date", "6")
+
+	dir := t.TempDir()
+	config := testConfig(server.Addr(), bets)
+	config.ValidationMode = common.ValidationQuarantine
+	config.QuarantineFile = filepath.Join(dir, "quarantine.csv")
+	config.ResumeStateFile = filepath.Join(dir, "state.json")
+	config.MaxRejectRatio = 0.05
+	config.ResumeMaxRetries = 0
+
+	// The first run stops once the connection drops, after the invalid rows
+	// were quarantined and their batches stored
+	if err := common.NewClient(config).Start(context.Background()); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+
+	// The restarted client skips the stored batches, so it does not read the
+	// invalid rows again, but still counts them
+	err := common.NewClient(config).Start(context.Background())
+	if !errors.Is(err, common.ErrTooManyRejects) {
+		t.Fatalf("expected the rows rejected before the restart to be counted, got %v", err)
+	}
+
+	quarantine, err := ioutil.ReadFile(config.QuarantineFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "file,line,raw,reason\nmemory,3,"
+	if !strings.HasPrefix(string(quarantine), expected) || strings.Count(string(quarantine), "\n") != 3 || !strings.Contains(string(quarantine), "\nmemory,6,") {
+		t.Fatalf("expected lines 3 and 6 to be kept in quarantine, got:\n%s", quarantine)
+	}
+}
+
+func TestClientResumesFromStaleState(t *testing.T) {
+	var once sync.Once
+	server := startServer(t, fakeserver.Options{
+		// Batches sent again would be stored twice
+		DisabledFeatures: fakeserver.FeatureIdempotentBatches,
+		Hooks: fakeserver.Hooks{
+			Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+				fault := fakeserver.Fault{}
+				if batch.Seq == 14 {
+					once.Do(func() { fault = fakeserver.Fault{DisconnectAfterStore: true} })
+				}
+				return fault
+			},
+		},
+	})
+	bets := testBets(100)
+
+	config := testConfig(server.Addr(), bets)
+	config.ResumeStateFile = filepath.Join(t.TempDir(), "state.json")
+	config.ResumeMaxRetries = 0
+
+	// The state saved a few batches before the server stored the last one,
+	// as left by a client that stopped before saving it again
+	var staleState []byte
+	config.OnBatchAcked = func(ack common.BatchAck) {
+		if ack.Seq == 10 {
+			staleState, _ = ioutil.ReadFile(config.ResumeStateFile)
+		}
+	}
+	if err := common.NewClient(config).Start(context.Background()); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	if staleState == nil {
+		t.Fatal("expected the state to be saved before batch 10 was acknowledged")
+	}
+	if err := ioutil.WriteFile(config.ResumeStateFile, staleState, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.OnBatchAcked = nil
+	if err := common.NewClient(config).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, server, bets)
+}
+
+func TestClientDoesNotResumeChangedFiles(t *testing.T) {
+	var once sync.Once
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+				fault := fakeserver.Fault{}
+				if batch.Seq == 2 {
+					once.Do(func() { fault = fakeserver.Fault{Disconnect: true} })
+				}
+				return fault
+			},
+		},
+	})
+
+	dir := t.TempDir()
+	rows := ""
+	for i := 1; i <= 25; i++ {
+		rows += fmt.Sprintf("Santiago,Lorca %d,%d,1999-03-17,%d\n", i, 30000000+i, i)
+	}
+	betsFile := filepath.Join(dir, "agency-1.csv")
+	if err := ioutil.WriteFile(betsFile, []byte(rows), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(server.Addr(), nil)
+	config.OpenBets = nil
+	config.BetsFiles = betsFile
+	config.CSV = common.DefaultCSVOptions()
+	config.ResumeStateFile = filepath.Join(dir, "state.json")
+	config.ResumeMaxRetries = 0
+
+	if err := common.NewClient(config).Start(context.Background()); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+
+	// The file is replaced by one with a row less at the start, so the
+	// records consumed no longer point to the same rows
+	if err := ioutil.WriteFile(betsFile, []byte(rows[strings.Index(rows, "\n")+1:]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := common.NewClient(config).Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "bets files changed") {
+		t.Fatalf("expected the upload not to be resumed, got %v", err)
+	}
+}
+
+func TestClientRetriesAfterAckTimeout(t *testing.T) {
+	var once sync.Once
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+				fault := fakeserver.Fault{}
+				once.Do(func() { fault.Delay = 500 * time.Millisecond })
+				return fault
+			},
+		},
+	})
+	bets := testBets(10)
+
+	config := testConfig(server.Addr(), bets)
+	config.Timeouts.Ack = 100 * time.Millisecond
+	if err := common.NewClient(config).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStored(t, server, bets)
+}
+
+func TestClientStopsWhenResultsFail(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Results: func(agency uint32, request int) fakeserver.Fault {
+				return fakeserver.Fault{Error: fakeserver.NewError(fakeserver.ErrorUnknown, "results unavailable")}
+			},
+		},
+	})
+
+	err := common.NewClient(testConfig(server.Addr(), testBets(5))).Start(context.Background())
+	var serverErr *common.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Message != "results unavailable" {
+		t.Fatalf("expected the error of the server, got %v", err)
+	}
+}
+
+func TestClientGivesUpWaitingWinners(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Results: func(agency uint32, request int) fakeserver.Fault {
+				return fakeserver.Fault{NotReady: true}
+			},
+		},
+	})
+
+	config := testConfig(server.Addr(), testBets(5))
+	config.Retry.MaxAttempts = 2
+	err := common.NewClient(config).Start(context.Background())
+	if !errors.Is(err, common.ErrWinnersNotReady) {
+		t.Fatalf("expected the client to give up waiting the winners, got %v", err)
+	}
+	if requests := server.ResultsRequests(1); requests != 2 {
+		t.Fatalf("expected the winners to be requested twice, got %d requests", requests)
+	}
+}
+
+func TestClientSpeaksLegacyProtocol(t *testing.T) {
+	server := startServer(t, fakeserver.Options{Legacy: true})
+	bets := testBets(10)
+
+	if err := common.NewClient(testConfig(server.Addr(), bets)).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStored(t, server, bets)
+	if !server.Raffled() {
+		t.Fatal("expected the raffle to be performed")
+	}
+}
+
+func TestClientRejectsUnsupportedServerVersion(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Handshake: func(connection int) fakeserver.Fault {
+				return fakeserver.Fault{Error: fakeserver.NewError(fakeserver.ErrorMalformedMessage, "Unsupported protocol version")}
+			},
+		},
+	})
+
+	err := common.NewClient(testConfig(server.Addr(), testBets(10))).Start(context.Background())
+	if !errors.Is(err, common.ErrUnsupportedServerVersion) {
+		t.Fatalf("expected the server to be unsupported, got %v", err)
+	}
+	if server.Connections() != 1 || len(server.Bets()) != 0 {
+		t.Fatalf("expected no retries nor bets stored, got %d connections and %d bets", server.Connections(), len(server.Bets()))
+	}
+}
+
+func TestClientAuthenticates(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Secrets: map[uint32][]byte{1: []byte("secret")},
+	})
+	bets := testBets(10)
+
+	config := testConfig(server.Addr(), bets)
+	config.AgencySecret = []byte("wrong")
+	if err := common.NewClient(config).Start(context.Background()); !errors.Is(err, common.ErrAuthenticationFailed) {
+		t.Fatalf("expected a wrong secret to be rejected, got %v", err)
+	}
+
+	config.AgencySecret = []byte("secret")
+	if err := common.NewClient(config).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, server, bets)
+}
+
+func TestClientStopsOnCancel(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Hooks: fakeserver.Hooks{
+			Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+				return fakeserver.Fault{Delay: 50 * time.Millisecond}
+			},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := common.NewClient(testConfig(server.Addr(), testBets(100))).Start(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the client to stop when cancelled, got %v", err)
+	}
+	if server.Completed(1) {
+		t.Fatal("expected the upload not to be completed")
+	}
+}
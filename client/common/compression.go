@@ -0,0 +1,86 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// when compression is negotiated, every non empty frame payload starts with
+// a byte identifying how the rest of it is encoded
+const _CODEC_SIZE = 1
+const _CODEC_NONE = 0
+const _CODEC_GZIP = 1
+
+// compressor Encodes frame payloads with gzip, reusing its buffers between
+// frames
+type compressor struct {
+	buf    bytes.Buffer
+	writer *gzip.Writer
+}
+
+func newCompressor() *compressor {
+	c := &compressor{}
+	c.writer = gzip.NewWriter(&c.buf)
+	return c
+}
+
+// encode Returns the payload prefixed by its codec. It is sent as is if
+// compressing it would not make it smaller, so the encoded payload is never
+// more than a byte longer than the original one
+func (c *compressor) encode(payload []byte) ([]byte, error) {
+	c.buf.Reset()
+	c.buf.WriteByte(_CODEC_GZIP)
+	c.writer.Reset(&c.buf)
+
+	if _, err := c.writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+
+	if c.buf.Len() < _CODEC_SIZE+len(payload) {
+		return append([]byte(nil), c.buf.Bytes()...), nil
+	}
+
+	encoded := make([]byte, 0, _CODEC_SIZE+len(payload))
+	encoded = append(encoded, _CODEC_NONE)
+	return append(encoded, payload...), nil
+}
+
+// decodePayload Decodes a payload prefixed by its codec, failing if the
+// decoded payload would be longer than maxSize
+func decodePayload(payload []byte, maxSize uint32) ([]byte, error) {
+	if len(payload) < _CODEC_SIZE {
+		return nil, fmt.Errorf("frame without codec")
+	}
+
+	codec, data := payload[0], payload[_CODEC_SIZE:]
+	switch codec {
+	case _CODEC_NONE:
+		return data, nil
+	case _CODEC_GZIP:
+	default:
+		return nil, fmt.Errorf("unsupported codec: %d", codec)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed frame: %w", err)
+	}
+	defer reader.Close()
+
+	// One byte more than allowed is read to detect oversized payloads
+	// without decompressing them entirely
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed frame: %w", err)
+	}
+	if uint64(len(decoded)) > uint64(maxSize) {
+		return nil, fmt.Errorf("decompressed frame exceeds max size of %d bytes", maxSize)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// sample agency files, relative to this package
+const _DATASET = "../../.data/dataset.zip"
+
+func TestCompressorRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("Santiago Lionel,Lorca,30904465,1999-03-17,7574\n"), 100)
+
+	encoded, err := newCompressor().encode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded[0] != _CODEC_GZIP || len(encoded) >= len(payload) {
+		t.Fatalf("expected a compressed payload, got codec %d and %d bytes", encoded[0], len(encoded))
+	}
+
+	decoded, err := decodePayload(encoded, uint32(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Fatal("decoded payload does not match the original one")
+	}
+
+	if _, err := decodePayload(encoded, uint32(len(payload)-1)); err == nil {
+		t.Fatal("expected a payload expanding beyond the max size to be rejected")
+	}
+}
+
+func TestCompressorSendsIncompressiblePayloadsAsIs(t *testing.T) {
+	payload := make([]byte, 1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := newCompressor().encode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded[0] != _CODEC_NONE || len(encoded) != _CODEC_SIZE+len(payload) {
+		t.Fatalf("expected the payload to be sent as is, got codec %d and %d bytes", encoded[0], len(encoded))
+	}
+
+	decoded, err := decodePayload(encoded, uint32(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Fatal("decoded payload does not match the original one")
+	}
+}
+
+func TestDecodePayloadRejectsInvalidFrames(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":         {},
+		"unknown codec": {7, 1, 2, 3},
+		"invalid gzip":  {_CODEC_GZIP, 1, 2, 3},
+	}
+
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodePayload(payload, 1024); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// BenchmarkBatchBytesOnWire Compares the bytes sent to upload each sample
+// agency file with and without compression, using the default batch limits
+func BenchmarkBatchBytesOnWire(b *testing.B) {
+	archive, err := zip.OpenReader(_DATASET)
+	if err != nil {
+		b.Skipf("sample dataset not available: %v", err)
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if !strings.HasSuffix(file.Name, ".csv") {
+			continue
+		}
+
+		input, err := NewBetsInput(_DATASET + "#" + file.Name)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, compression := range []bool{false, true} {
+			codec := "raw"
+			features := uint32(_FEATURE_WIDE_IDS | _FEATURE_PIPELINING | _FEATURE_IDEMPOTENT_BATCHES)
+			if compression {
+				codec = "gzip"
+				features |= _FEATURE_COMPRESSION
+			}
+
+			b.Run(fmt.Sprintf("%s/%s", strings.TrimSuffix(file.Name, ".csv"), codec), func(b *testing.B) {
+				proto := &Protocol{GetBetSize: serializedBetSize, maxFrameSize: 8 * 1024, features: features}
+
+				wireBytes := 0
+				for i := 0; i < b.N; i++ {
+					wireBytes = bytesOnWire(b, proto, input)
+				}
+				b.SetBytes(int64(file.UncompressedSize64))
+				b.ReportMetric(float64(wireBytes), "wire-bytes")
+			})
+		}
+	}
+}
+
+// bytesOnWire Returns the size of all the frames needed to send the bets
+func bytesOnWire(b *testing.B, proto *Protocol, input *BetsInput) int {
+	bets := input.Open("1", "", DefaultCSVOptions())
+	defer bets.Close()
+	generator := NewBatchGenerator(bets, nil, 150, proto.MaxBatchSize(), proto.GetBetSize)
+
+	total := 0
+	for seq := uint32(0); ; seq++ {
+		batch, err := generator.GetNextBatch()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(batch) == 0 {
+			return total
+		}
+
+		payload, err := proto.encodeBatch(seq, batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+		total += _FRAME_HEADER_SIZE + len(payload)
+	}
+}
@@ -0,0 +1,335 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/fakeserver"
+)
+
+var update = flag.Bool("update", false, "record the golden transcripts again with the client")
+var server = flag.String("server", "", "address of a fresh server expecting a single agency to replay the golden transcripts against, instead of the fake server")
+
+const _TIMEOUT = 5 * time.Second
+
+// exchange A conversation between agency 1 and the server, recorded in its
+// own golden transcript. Exchanges must run in order, as each of them
+// depends on what the server stored in the previous ones
+type exchange struct {
+	name     string
+	comments []string
+	run      func(ctx context.Context, recorder *Recorder) error
+}
+
+var (
+	winner       = common.NewBet("1", "Santiago Lionel", "Lorca", "30000001", "1999-03-17", "7574")
+	loser        = common.NewBet("1", "Ana", "Diaz", "30000002", "2001-02-03", "1")
+	otherWinner  = common.NewBet("1", "Juan", "Perez", "30000003", "1980-12-31", "7574")
+	other        = common.NewBet("1", "María José", "Núñez", "30000004", "1975-06-15", "42")
+	invalid      = common.NewBet("1", "Pedro", "Gomez", "30000005", "1999-02-30", "7")
+	uncompressed = common.NewBet("1", "Luis", "Sosa", "30000006", "1990-01-01", "9")
+)
+
+var exchanges = []exchange{
+	{
+		name: "handshake",
+		comments: []string{
+			"The client advertises version 2 and its features, and the server answers",
+			"with the version and the features both support",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := connect(ctx, recorder)
+			if err != nil {
+				return err
+			}
+			return proto.Close()
+		},
+	},
+	{
+		name: "results_not_ready",
+		comments: []string{
+			"Winners requested before every agency finished its upload",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := connect(ctx, recorder)
+			if err != nil {
+				return err
+			}
+			defer proto.Close()
+
+			winners, err := proto.RequestResults(ctx, 1)
+			if err != nil || winners != nil {
+				return fmt.Errorf("expected the results not to be ready, got %v and %v", winners, err)
+			}
+			return recorder.WaitServerClose(_TIMEOUT)
+		},
+	},
+	{
+		name: "start_sending",
+		comments: []string{
+			"The client starts the upload asking for frames of up to 8192 bytes, and",
+			"the server answers the size it accepts and that nothing was stored yet",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := startSending(ctx, recorder)
+			if err != nil {
+				return err
+			}
+			return proto.Close()
+		},
+	},
+	{
+		name: "batch_ack",
+		comments: []string{
+			"Two batches of two bets, acknowledged by their sequence numbers, and the",
+			"second one sent again, which the server does not store twice",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := startSending(ctx, recorder)
+			if err != nil {
+				return err
+			}
+			defer proto.Close()
+
+			if err := sendBatch(ctx, proto, common.Ack{Seq: 0}, winner, loser); err != nil {
+				return err
+			}
+			if err := sendBatch(ctx, proto, common.Ack{Seq: 1}, otherWinner, other); err != nil {
+				return err
+			}
+			proto.SetNextSeq(1)
+			return sendBatch(ctx, proto, common.Ack{Seq: 1, AlreadyStored: true}, otherWinner, other)
+		},
+	},
+	{
+		name: "error",
+		comments: []string{
+			"A batch with a bet born on February 30th, rejected with a structured",
+			"error pointing to its batch and position before closing the connection.",
+			"The message is not part of the contract",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := startSending(ctx, recorder)
+			if err != nil {
+				return err
+			}
+			defer proto.Close()
+
+			proto.SetNextSeq(2)
+			err = sendBatch(ctx, proto, common.Ack{}, loser, invalid)
+			var serverErr *common.ServerError
+			if !errors.As(err, &serverErr) || serverErr.Code != common.ErrorInvalidBet || serverErr.Seq != 2 || serverErr.BetIndex != 1 {
+				return fmt.Errorf("expected the second bet of batch 2 to be rejected, got %v", err)
+			}
+			return recorder.WaitServerClose(_TIMEOUT)
+		},
+	},
+	{
+		name: "compression",
+		comments: []string{
+			"The client also advertises compression, and sends a batch of a single",
+			"bet with codec 0x00, as gzip would not make it any smaller",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := startSendingWith(ctx, recorder, true)
+			if err != nil {
+				return err
+			}
+			defer proto.Close()
+
+			if !proto.Compressed() {
+				return fmt.Errorf("expected compression to be negotiated")
+			}
+			return sendBatch(ctx, proto, common.Ack{Seq: 2}, uncompressed)
+		},
+	},
+	{
+		name: "completion",
+		comments: []string{
+			"The upload is resumed after the last batch stored and completed with an",
+			"empty frame, after which the server closes the connection",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := startSending(ctx, recorder)
+			if err != nil {
+				return err
+			}
+			defer proto.Close()
+
+			if err := proto.InformCompletion(ctx); err != nil {
+				return err
+			}
+			return recorder.WaitServerClose(_TIMEOUT)
+		},
+	},
+	{
+		name: "winners",
+		comments: []string{
+			"Once the only agency finished its upload, the winners are the documents",
+			"of its bets on 7574, separated by $ and followed by their checksum",
+		},
+		run: func(ctx context.Context, recorder *Recorder) error {
+			proto, err := connect(ctx, recorder)
+			if err != nil {
+				return err
+			}
+			defer proto.Close()
+
+			winners, err := proto.RequestResults(ctx, 1)
+			if err != nil || !reflect.DeepEqual(winners, []string{"30000001", "30000003"}) {
+				return fmt.Errorf("expected the winners of agency 1, got %v and %v", winners, err)
+			}
+			return recorder.WaitServerClose(_TIMEOUT)
+		},
+	},
+}
+
+// connect Connects to the server through the recorder. Compression is not
+// advertised, as compressed payloads depend on the implementation of gzip
+func connect(ctx context.Context, recorder *Recorder) (*common.Protocol, error) {
+	return connectWith(ctx, recorder, false)
+}
+
+// connectWith Connects to the server through the recorder, advertising
+// compression if asked to. Payloads too small to shrink are still sent
+// uncompressed, so they do not depend on gzip
+func connectWith(ctx context.Context, recorder *Recorder, compression bool) (*common.Protocol, error) {
+	return common.NewProtocol(ctx, recorder.Addr(), common.ProtocolOptions{
+		Timeouts:    common.Timeouts{Connect: _TIMEOUT, Write: _TIMEOUT, Ack: _TIMEOUT, Results: _TIMEOUT},
+		Compression: compression,
+	})
+}
+
+// startSending Starts the upload of agency 1, continuing after the last
+// batch stored
+func startSending(ctx context.Context, recorder *Recorder) (*common.Protocol, error) {
+	return startSendingWith(ctx, recorder, false)
+}
+
+// startSendingWith Starts the upload of agency 1 like startSending,
+// advertising compression if asked to
+func startSendingWith(ctx context.Context, recorder *Recorder, compression bool) (*common.Protocol, error) {
+	proto, err := connectWith(ctx, recorder, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := proto.StartSendingBets(ctx, 1, 8192); err != nil {
+		proto.Close()
+		return nil, err
+	}
+
+	status, err := proto.ResumeUpload(ctx)
+	if err != nil {
+		proto.Close()
+		return nil, err
+	}
+	if status.HasCommitted {
+		proto.SetNextSeq(status.LastCommittedSeq + 1)
+	}
+	return proto, nil
+}
+
+// sendBatch Sends the bets in a batch, checking the server acknowledges it
+func sendBatch(ctx context.Context, proto *common.Protocol, expected common.Ack, bets ...*common.Bet) error {
+	if _, err := proto.SendBatch(ctx, bets); err != nil {
+		return err
+	}
+
+	ack, err := proto.WaitConfirmation(ctx)
+	if err != nil {
+		return err
+	}
+	if ack != expected {
+		return fmt.Errorf("expected acknowledgement %+v, got %+v", expected, ack)
+	}
+	return nil
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", name+".txt")
+}
+
+// TestClientMatchesGoldenTranscripts Records the exchanges of the client with
+// the fake server and compares them with the golden transcripts, or
+// overwrites them with -update
+func TestClientMatchesGoldenTranscripts(t *testing.T) {
+	fake, err := fakeserver.Start(fakeserver.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	for _, exchange := range exchanges {
+		recorder, err := NewRecorder(fake.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := exchange.run(context.Background(), recorder); err != nil {
+			t.Fatalf("%v: %v", exchange.name, err)
+		}
+		transcript, err := recorder.Transcript(_TIMEOUT)
+		if err != nil {
+			t.Fatalf("%v: %v", exchange.name, err)
+		}
+		transcript.Comments = exchange.comments
+		transcript.MaskErrorMessages()
+
+		if *update {
+			if err := ioutil.WriteFile(goldenPath(exchange.name), []byte(transcript.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		golden, err := ioutil.ReadFile(goldenPath(exchange.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(golden) != transcript.String() {
+			t.Errorf("%v: client no longer matches the golden transcript\nexpected:\n%v\ngot:\n%v", exchange.name, string(golden), transcript)
+		}
+	}
+}
+
+// TestServerConformance Replays the golden transcripts against the server
+// given with -server, or a fake server if none is given
+func TestServerConformance(t *testing.T) {
+	address := *server
+	if address == "" {
+		fake, err := fakeserver.Start(fakeserver.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fake.Close()
+		address = fake.Addr()
+	}
+
+	for _, exchange := range exchanges {
+		file, err := os.Open(goldenPath(exchange.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		transcript, err := Parse(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", exchange.name, err)
+		}
+
+		// Exchanges depend on the previous ones, so the first failure stops
+		// the replay
+		if err := Replay(address, transcript, _TIMEOUT); err != nil {
+			t.Fatalf("%v: %v", exchange.name, err)
+		}
+	}
+}
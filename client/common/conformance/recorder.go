@@ -0,0 +1,137 @@
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Recorder A proxy that forwards a single connection to the server and
+// records the bytes each side sends as a transcript
+type Recorder struct {
+	listener   net.Listener
+	target     string
+	mu         sync.Mutex
+	transcript Transcript
+	// clientClosed is set once the client closes the connection, after
+	// which the server closing it is expected and not recorded
+	clientClosed bool
+	serverClosed chan struct{}
+	done         chan struct{}
+}
+
+// NewRecorder Starts a recorder of the next connection to the target
+// server, listening on a random loopback port
+func NewRecorder(target string) (*Recorder, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		listener:     listener,
+		target:       target,
+		serverClosed: make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go r.proxy()
+	return r, nil
+}
+
+// Addr Returns the address the client must connect to
+func (r *Recorder) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *Recorder) proxy() {
+	defer close(r.done)
+	defer r.listener.Close()
+
+	client, err := r.listener.Accept()
+	if err != nil {
+		close(r.serverClosed)
+		return
+	}
+	defer client.Close()
+
+	server, err := net.Dial("tcp", r.target)
+	if err != nil {
+		close(r.serverClosed)
+		return
+	}
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.forward(client, server, true)
+		r.mu.Lock()
+		r.clientClosed = true
+		r.mu.Unlock()
+		server.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		r.forward(server, client, false)
+		r.mu.Lock()
+		if !r.clientClosed {
+			r.transcript.add(false, Chunk{EOF: true})
+		}
+		r.mu.Unlock()
+		close(r.serverClosed)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	wg.Wait()
+}
+
+// forward Copies everything src sends to dst, recording it
+func (r *Recorder) forward(src net.Conn, dst net.Conn, fromClient bool) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			r.mu.Lock()
+			r.transcript.add(fromClient, Chunk{Data: append([]byte(nil), buf[:n]...)})
+			r.mu.Unlock()
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				dst.Close()
+			}
+			return
+		}
+	}
+}
+
+// WaitServerClose Waits for the server to close the connection, so it is
+// recorded before the client closes its side
+func (r *Recorder) WaitServerClose(timeout time.Duration) error {
+	select {
+	case <-r.serverClosed:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("server did not close the connection within %v", timeout)
+	}
+}
+
+// Transcript Waits for both sides to close the connection and returns what
+// they sent
+func (r *Recorder) Transcript(timeout time.Duration) (*Transcript, error) {
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+		r.listener.Close()
+		return nil, fmt.Errorf("connection not closed within %v", timeout)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transcript := r.transcript
+	return &transcript, nil
+}
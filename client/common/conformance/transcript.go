@@ -0,0 +1,270 @@
+// Package conformance records the bytes exchanged between the client and the
+// server as transcripts, and replays them against a server to check it still
+// speaks the protocol the agencies expect.
+//
+// A transcript is a text file with one turn per group of lines. Lines
+// starting with ">" are sent by the client and lines starting with "<" are
+// expected from the server, both as hexadecimal bytes where spaces are
+// ignored. Consecutive lines with the same direction belong to the same
+// turn. Server lines may also hold "~str16", any string prefixed by its
+// uint16 length, for human readable text that is not part of the contract,
+// and "eof", the server closing the connection. Lines starting with "#" are
+// comments
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const _CLIENT_PREFIX = ">"
+const _SERVER_PREFIX = "<"
+const _COMMENT_PREFIX = "#"
+const _ANY_STRING16 = "~str16"
+const _EOF = "eof"
+
+// bytes rendered in each line of a transcript
+const _BYTES_PER_LINE = 16
+
+// in a structured error, _ERROR_CODE is followed by the error code, the
+// sequence number, the bet index and the uint16 length of the message
+const _ERROR_CODE = 5
+const _ERROR_HEADER_SIZE = 1 + 1 + 4 + 4 + 2
+
+// Chunk A part of a turn: fixed bytes, a string of any content prefixed by
+// its uint16 length, or the connection being closed
+type Chunk struct {
+	Data        []byte
+	AnyString16 bool
+	EOF         bool
+}
+
+// Turn The bytes sent by one side before the other answers
+type Turn struct {
+	FromClient bool
+	Chunks     []Chunk
+}
+
+// Transcript The turns of a connection between the client and the server,
+// along with the comments that describe them
+type Transcript struct {
+	Comments []string
+	Turns    []Turn
+}
+
+// Parse Reads a transcript
+func Parse(r io.Reader) (*Transcript, error) {
+	transcript := &Transcript{}
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, _COMMENT_PREFIX) {
+			transcript.Comments = append(transcript.Comments, strings.TrimSpace(strings.TrimPrefix(line, _COMMENT_PREFIX)))
+			continue
+		}
+
+		var fromClient bool
+		switch {
+		case strings.HasPrefix(line, _CLIENT_PREFIX):
+			fromClient = true
+		case strings.HasPrefix(line, _SERVER_PREFIX):
+		default:
+			return nil, fmt.Errorf("line %d: expected %q, %q or %q", number, _CLIENT_PREFIX, _SERVER_PREFIX, _COMMENT_PREFIX)
+		}
+
+		chunks, err := parseChunks(line[1:], fromClient)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		transcript.add(fromClient, chunks...)
+	}
+	return transcript, scanner.Err()
+}
+
+// parseChunks Parses the hexadecimal bytes and placeholders of a line
+func parseChunks(line string, fromClient bool) ([]Chunk, error) {
+	chunks := make([]Chunk, 0)
+	var data strings.Builder
+	flush := func() error {
+		if data.Len() == 0 {
+			return nil
+		}
+		decoded, err := hex.DecodeString(data.String())
+		if err != nil {
+			return fmt.Errorf("invalid bytes %q: %w", data.String(), err)
+		}
+		chunks = append(chunks, Chunk{Data: decoded})
+		data.Reset()
+		return nil
+	}
+
+	for _, word := range strings.Fields(line) {
+		if word != _ANY_STRING16 && word != _EOF {
+			data.WriteString(word)
+			continue
+		}
+		if fromClient {
+			return nil, fmt.Errorf("%q can only be expected from the server", word)
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, Chunk{AnyString16: word == _ANY_STRING16, EOF: word == _EOF})
+	}
+	return chunks, flush()
+}
+
+// add Appends the chunks to the last turn if it has the same direction, or
+// to a new one otherwise
+func (t *Transcript) add(fromClient bool, chunks ...Chunk) {
+	if len(t.Turns) == 0 || t.Turns[len(t.Turns)-1].FromClient != fromClient {
+		t.Turns = append(t.Turns, Turn{FromClient: fromClient})
+	}
+
+	turn := &t.Turns[len(t.Turns)-1]
+	for _, chunk := range chunks {
+		last := len(turn.Chunks) - 1
+		if chunk.Data != nil && last >= 0 && turn.Chunks[last].Data != nil {
+			turn.Chunks[last].Data = append(turn.Chunks[last].Data, chunk.Data...)
+			continue
+		}
+		turn.Chunks = append(turn.Chunks, chunk)
+	}
+}
+
+// String Returns the transcript in the format read by Parse
+func (t *Transcript) String() string {
+	var buf strings.Builder
+	for _, comment := range t.Comments {
+		fmt.Fprintf(&buf, "%v %v\n", _COMMENT_PREFIX, comment)
+	}
+
+	for _, turn := range t.Turns {
+		prefix := _SERVER_PREFIX
+		if turn.FromClient {
+			prefix = _CLIENT_PREFIX
+		}
+
+		for _, chunk := range turn.Chunks {
+			switch {
+			case chunk.AnyString16:
+				fmt.Fprintf(&buf, "%v %v\n", prefix, _ANY_STRING16)
+			case chunk.EOF:
+				fmt.Fprintf(&buf, "%v %v\n", prefix, _EOF)
+			default:
+				for start := 0; start < len(chunk.Data); start += _BYTES_PER_LINE {
+					end := start + _BYTES_PER_LINE
+					if end > len(chunk.Data) {
+						end = len(chunk.Data)
+					}
+					fmt.Fprintf(&buf, "%v % x\n", prefix, chunk.Data[start:end])
+				}
+			}
+		}
+	}
+	return buf.String()
+}
+
+// MaskErrorMessages Replaces the message of every structured error the server
+// answers with ~str16, as it is meant for humans and each server words it
+// its own way
+func (t *Transcript) MaskErrorMessages() {
+	for i := range t.Turns {
+		turn := &t.Turns[i]
+		if turn.FromClient || len(turn.Chunks) == 0 {
+			continue
+		}
+
+		data := turn.Chunks[0].Data
+		if len(data) < _ERROR_HEADER_SIZE || data[0] != _ERROR_CODE {
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[_ERROR_HEADER_SIZE-2:]))
+		if len(data) < _ERROR_HEADER_SIZE+length {
+			continue
+		}
+
+		masked := []Chunk{{Data: data[:_ERROR_HEADER_SIZE-2]}, {AnyString16: true}}
+		if rest := data[_ERROR_HEADER_SIZE+length:]; len(rest) > 0 {
+			masked = append(masked, Chunk{Data: rest})
+		}
+		turn.Chunks = append(masked, turn.Chunks[1:]...)
+	}
+}
+
+// Replay Connects to the server, sends the turns of the client and checks
+// the server answers exactly the turns of the server, waiting up to timeout
+// for each of them
+func Replay(address string, transcript *Transcript, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i, turn := range transcript.Turns {
+		if turn.FromClient {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+			for _, chunk := range turn.Chunks {
+				if _, err := conn.Write(chunk.Data); err != nil {
+					return fmt.Errorf("turn %d: could not send: %w", i+1, err)
+				}
+			}
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for _, chunk := range turn.Chunks {
+			if err := expect(conn, chunk); err != nil {
+				return fmt.Errorf("turn %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expect Reads the chunk from the server, failing if it does not match
+func expect(conn net.Conn, chunk Chunk) error {
+	switch {
+	case chunk.EOF:
+		buf := make([]byte, 1)
+		n, err := conn.Read(buf)
+		if n > 0 {
+			return fmt.Errorf("expected the connection to be closed, got % x", buf[:n])
+		}
+		if err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+			return nil
+		}
+		return fmt.Errorf("expected the connection to be closed, got %v", err)
+
+	case chunk.AnyString16:
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fmt.Errorf("expected a string, got %v", err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint16(length))); err != nil {
+			return fmt.Errorf("expected a string of %d bytes, got %v", binary.BigEndian.Uint16(length), err)
+		}
+		return nil
+
+	default:
+		received := make([]byte, len(chunk.Data))
+		n, err := io.ReadFull(conn, received)
+		if !bytes.Equal(received[:n], chunk.Data[:n]) || err != nil {
+			return fmt.Errorf("expected % x, got % x (%v)", chunk.Data, received[:n], err)
+		}
+		return nil
+	}
+}
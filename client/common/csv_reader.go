@@ -0,0 +1,263 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// amount of fields of a bet read from the csv
+const _BET_FIELDS = 5
+
+var _UTF8_BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// CSVColumns Names of the columns holding each field of the bets, used when
+// the csv has a header row
+type CSVColumns struct {
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate string
+	Number    string
+}
+
+// CSVOptions Layout of the csv with the bets of the agency
+type CSVOptions struct {
+	Delimiter rune
+	// Header means the first row names the columns, which are then looked
+	// up by name. Otherwise every row has exactly the fields of a bet, in
+	// the order of CSVColumns
+	Header  bool
+	Columns CSVColumns
+}
+
+// DefaultCSVOptions Returns the layout of the csv files of the agencies: comma
+// separated and without header
+func DefaultCSVOptions() CSVOptions {
+	return CSVOptions{
+		Delimiter: ',',
+		Columns: CSVColumns{
+			FirstName: "first_name",
+			LastName:  "last_name",
+			Document:  "document",
+			Birthdate: "birthdate",
+			Number:    "number",
+		},
+	}
+}
+
+// RejectedRow A row of the csv that is not sent to the server, because it
+// could not be parsed or its bet is invalid
+type RejectedRow struct {
+	// File is the name of the file the row was read from, if known
+	File   string
+	Line   int
+	Raw    string
+	Reason error
+}
+
+func (row *RejectedRow) Error() string {
+	if row.File == "" {
+		return fmt.Sprintf("invalid bet at csv line %d: %v", row.Line, row.Reason)
+	}
+	return fmt.Sprintf("invalid bet at %v line %d: %v", row.File, row.Line, row.Reason)
+}
+
+func (row *RejectedRow) Unwrap() error {
+	return row.Reason
+}
+
+// CSVBetReader Reads the bets of an agency from a csv, keeping the line each
+// of them starts at to report errors
+type CSVBetReader struct {
+	agency string
+	reader *csv.Reader
+	lines  *lineRecorder
+	// position in each record of the fields of a bet, in the order
+	// expected by newBet
+	columns [_BET_FIELDS]int
+	// lines spanned by the last record read
+	firstLine int
+	lastLine  int
+}
+
+// NewCSVBetReader Creates a reader of the bets of the agency in r, reading the
+// header row right away if the options say there is one. A leading UTF-8 BOM
+// is ignored
+func NewCSVBetReader(agency string, r io.Reader, options CSVOptions) (*CSVBetReader, error) {
+	buffered := bufio.NewReader(r)
+	if prefix, _ := buffered.Peek(len(_UTF8_BOM)); bytes.Equal(prefix, _UTF8_BOM) {
+		buffered.Discard(len(_UTF8_BOM))
+	}
+
+	lines := newLineRecorder(buffered)
+	reader := csv.NewReader(lines)
+	reader.Comma = options.Delimiter
+	reader.FieldsPerRecord = _BET_FIELDS
+
+	betReader := &CSVBetReader{agency: agency, reader: reader, lines: lines}
+	if !options.Header {
+		for i := range betReader.columns {
+			betReader.columns[i] = i
+		}
+		return betReader, nil
+	}
+
+	// Every row must have as many fields as the header, which may have
+	// columns besides the ones of the bets
+	reader.FieldsPerRecord = 0
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("csv has no header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv header: %w", err)
+	}
+
+	if err := betReader.mapColumns(header, options.Columns); err != nil {
+		return nil, err
+	}
+	return betReader, nil
+}
+
+// mapColumns Finds the position of each field of the bets in the header
+func (r *CSVBetReader) mapColumns(header []string, columns CSVColumns) error {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if _, duplicated := positions[name]; duplicated {
+			return fmt.Errorf("csv header has column %q more than once", name)
+		}
+		positions[name] = i
+	}
+
+	names := [_BET_FIELDS]string{columns.FirstName, columns.LastName, columns.Document, columns.Birthdate, columns.Number}
+	for i, name := range names {
+		position, found := positions[name]
+		if !found {
+			return fmt.Errorf("csv header has no column %q", name)
+		}
+		r.columns[i] = position
+	}
+	return nil
+}
+
+// Next Returns the next bet of the csv, or io.EOF once there are no more.
+// A row that can not be parsed is returned as a *RejectedRow error, after
+// which the following rows can still be read
+func (r *CSVBetReader) Next() (*Bet, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+
+	var parseErr *csv.ParseError
+	if err != nil && !errors.As(err, &parseErr) {
+		return nil, err
+	}
+	if parseErr != nil && !errors.Is(parseErr.Err, csv.ErrFieldCount) {
+		// The rest of the record is unknown, but the reader already
+		// consumed it up to the line of the error
+		r.spanLines(parseErr.StartLine, parseErr.Line)
+		return nil, &RejectedRow{Line: parseErr.StartLine, Raw: r.Raw(), Reason: parseErr.Err}
+	}
+
+	firstLine, _ := r.reader.FieldPos(0)
+	lastLine, _ := r.reader.FieldPos(len(record) - 1)
+	r.spanLines(firstLine, lastLine+strings.Count(record[len(record)-1], "\n"))
+
+	if parseErr != nil {
+		reason := fmt.Errorf("row has %d fields instead of %d", len(record), r.reader.FieldsPerRecord)
+		return nil, &RejectedRow{Line: firstLine, Raw: r.Raw(), Reason: reason}
+	}
+
+	fields := make([]string, _BET_FIELDS)
+	for i, column := range r.columns {
+		fields[i] = record[column]
+	}
+
+	bet := newBet(r.agency, fields)
+	bet.line = firstLine
+	return bet, nil
+}
+
+// spanLines Records the lines spanned by the last record read, forgetting
+// the ones before it
+func (r *CSVBetReader) spanLines(first int, last int) {
+	r.firstLine, r.lastLine = first, last
+	r.lines.forget(first)
+}
+
+// Raw Returns the text of the last record read, as it is in the csv
+func (r *CSVBetReader) Raw() string {
+	return r.lines.text(r.firstLine, r.lastLine)
+}
+
+// lineRecorder Keeps the lines read through it until they are forgotten, so
+// the raw text of a rejected row can be reported. The csv reader reads ahead,
+// so the lines of the last record are kept until the next one is read
+type lineRecorder struct {
+	reader io.Reader
+	lines  []string
+	// number of the first line kept, starting from 1
+	first   int
+	partial []byte
+}
+
+func newLineRecorder(reader io.Reader) *lineRecorder {
+	return &lineRecorder{reader: reader, first: 1}
+}
+
+func (l *lineRecorder) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+
+	data := p[:n]
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		l.lines = append(l.lines, string(append(l.partial, data[:end]...)))
+		l.partial = l.partial[:0]
+		data = data[end+1:]
+	}
+	l.partial = append(l.partial, data...)
+
+	return n, err
+}
+
+// text Returns the lines from first to last, both included, without their
+// line terminators
+func (l *lineRecorder) text(first int, last int) string {
+	lines := make([]string, 0, last-first+1)
+	for number := first; number <= last; number++ {
+		index := number - l.first
+		if index < 0 {
+			continue
+		}
+		if index < len(l.lines) {
+			lines = append(lines, strings.TrimSuffix(l.lines[index], "\r"))
+		} else if index == len(l.lines) && len(l.partial) > 0 {
+			// The last line of the csv may not end with a line break
+			lines = append(lines, strings.TrimSuffix(string(l.partial), "\r"))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// forget Discards the lines before the given one
+func (l *lineRecorder) forget(line int) {
+	discarded := line - l.first
+	if discarded <= 0 {
+		return
+	}
+	if discarded > len(l.lines) {
+		discarded = len(l.lines)
+	}
+	l.lines = l.lines[discarded:]
+	l.first += discarded
+}
@@ -0,0 +1,161 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readAllBets Returns every bet in the csv, failing the test on error
+func readAllBets(t *testing.T, csv string, options CSVOptions) []*Bet {
+	t.Helper()
+
+	reader, err := NewCSVBetReader("1", strings.NewReader(csv), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bets := make([]*Bet, 0)
+	for {
+		bet, err := reader.Next()
+		if err == io.EOF {
+			return bets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		bets = append(bets, bet)
+	}
+}
+
+func TestCSVBetReaderParsesQuotedFields(t *testing.T) {
+	csv := "\xEF\xBB\xBF" +
+		"\"Santiago, Lionel\",Lorca,30904465,1999-03-17,7574\r\n" +
+		"\"Juan \"\"Pepe\"\"\",\"Perez\nGomez\",1,2000-01-01,1\r\n" +
+		"Ana,Diaz,2,2001-02-03,2\r\n"
+
+	bets := readAllBets(t, csv, DefaultCSVOptions())
+	if len(bets) != 3 {
+		t.Fatalf("expected 3 bets, got %d", len(bets))
+	}
+
+	expected := []Bet{
+		{agency: "1", firstName: "Santiago, Lionel", lastName: "Lorca", document: "30904465", birthday: "1999-03-17", number: "7574", line: 1},
+		{agency: "1", firstName: "Juan \"Pepe\"", lastName: "Perez\nGomez", document: "1", birthday: "2000-01-01", number: "1", line: 2},
+		{agency: "1", firstName: "Ana", lastName: "Diaz", document: "2", birthday: "2001-02-03", number: "2", line: 4},
+	}
+	for i, bet := range bets {
+		if *bet != expected[i] {
+			t.Errorf("expected bet %+v, got %+v", expected[i], *bet)
+		}
+	}
+}
+
+func TestCSVBetReaderMapsColumnsByName(t *testing.T) {
+	options := DefaultCSVOptions()
+	options.Delimiter = ';'
+	options.Header = true
+	options.Columns.Number = "numero"
+
+	csv := "number;numero;birthdate;document;extra;last_name;first_name\n" +
+		"9;7574;1999-03-17;30904465;x;Lorca;Santiago\n"
+
+	bets := readAllBets(t, csv, options)
+	expected := Bet{agency: "1", firstName: "Santiago", lastName: "Lorca", document: "30904465", birthday: "1999-03-17", number: "7574", line: 2}
+	if len(bets) != 1 || *bets[0] != expected {
+		t.Fatalf("expected bet %+v, got %+v", expected, bets)
+	}
+}
+
+func TestCSVBetReaderRejectsInvalidLayouts(t *testing.T) {
+	withHeader := DefaultCSVOptions()
+	withHeader.Header = true
+
+	tests := []struct {
+		name    string
+		csv     string
+		options CSVOptions
+	}{
+		{"extra column", "a,b,1,2000-01-01,1,extra\n", DefaultCSVOptions()},
+		{"missing column", "a,b,1,2000-01-01\n", DefaultCSVOptions()},
+		{"unterminated quote", "\"a,b,1,2000-01-01,1\n", DefaultCSVOptions()},
+		{"row shorter than header", "first_name,last_name,document,birthdate,number\na,b,1,2000-01-01\n", withHeader},
+		{"column missing from header", "first_name,last_name,document,birthdate\na,b,1,2000-01-01\n", withHeader},
+		{"duplicated column", "first_name,first_name,last_name,document,birthdate,number\n", withHeader},
+		{"empty csv with header", "", withHeader},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewCSVBetReader("1", strings.NewReader(test.csv), test.options)
+			if err != nil {
+				return
+			}
+			if _, err := reader.Next(); err == nil || err == io.EOF {
+				t.Fatalf("expected the csv to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateBetFromCSVLine(t *testing.T) {
+	bet := CreateBetFromCSVLine("1", "\"Lorca, Santiago\",Lorca,30904465,1999-03-17,7574")
+	if bet == nil || bet.firstName != "Lorca, Santiago" || bet.number != "7574" {
+		t.Fatalf("expected the quoted field to be kept whole, got %+v", bet)
+	}
+
+	for _, line := range []string{"a,b,1,2000-01-01", "a,b,1,2000-01-01,1,extra", ""} {
+		if bet := CreateBetFromCSVLine("1", line); bet != nil {
+			t.Errorf("expected %q to be rejected, got %+v", line, *bet)
+		}
+	}
+}
+
+func TestCSVBetReaderRejectsRowsAndContinues(t *testing.T) {
+	csv := "a,b,1,2000-01-01,1\r\n" +
+		"c,\"d\"x,2,2000-01-01,2\r\n" +
+		"e,f,3\r\n" +
+		"\"g\nh\",i,4,2000-01-01,4,extra\r\n" +
+		"j,k,5,2000-01-01,5"
+
+	reader, err := NewCSVBetReader("1", strings.NewReader(csv), DefaultCSVOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		line int
+		raw  string
+	}{
+		{2, "c,\"d\"x,2,2000-01-01,2"},
+		{3, "e,f,3"},
+		{4, "\"g\nh\",i,4,2000-01-01,4,extra"},
+	}
+
+	lines := make([]int, 0)
+	rejected := 0
+	for {
+		bet, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		var row *RejectedRow
+		if errors.As(err, &row) {
+			if rejected >= len(expected) || row.Line != expected[rejected].line || row.Raw != expected[rejected].raw {
+				t.Fatalf("unexpected rejected row %d at line %d: %q", rejected, row.Line, row.Raw)
+			}
+			rejected++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, bet.line)
+	}
+
+	if rejected != len(expected) || len(lines) != 2 || lines[0] != 1 || lines[1] != 6 {
+		t.Fatalf("expected bets at lines 1 and 6 and %d rejected rows, got %v and %d", len(expected), lines, rejected)
+	}
+}
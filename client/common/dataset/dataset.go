@@ -0,0 +1,384 @@
+// Package dataset generates synthetic agency files of bets for end-to-end
+// tests, along with a manifest of the winners the server must report for
+// each agency. The files have the layout of the sample dataset: csv rows of
+// first name, last name, document, birthdate and number, without a header.
+//
+// Valid rows respect the default validation rules of the client, and
+// invalid rows break exactly one of them, so the expected winners are the
+// valid rows betting the winning number, in the order of the file.
+// Pathological names are valid but unusual: non ASCII text, csv and
+// protocol separators, and names as long as the rules allow
+package dataset
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// ManifestFile is the name of the manifest written along the agency files
+const ManifestFile = "manifest.json"
+
+// DefaultWinningNumber is the number drawn by the server
+const DefaultWinningNumber = 7574
+
+// seeds of consecutive agencies are this far apart, so the rows of an agency
+// depend only on the seed and its id
+const _AGENCY_SEED_STRIDE = 1000003
+
+// Options Configuration of a generated dataset
+type Options struct {
+	// Agencies is the amount of agency files, with consecutive ids starting
+	// at FirstAgency
+	Agencies      int
+	FirstAgency   int
+	RowsPerAgency int
+	// WinningNumber is bet by a WinnerRatio fraction of the rows, and any
+	// other number by the rest
+	WinningNumber int
+	WinnerRatio   float64
+	// PathologicalRatio is the fraction of rows with a pathological first
+	// or last name
+	PathologicalRatio float64
+	// InvalidRatio is the fraction of rows the client must reject
+	InvalidRatio float64
+	Seed         int64
+}
+
+// DefaultOptions Returns the options of a dataset shaped like the sample one:
+// five agencies, with a winner every thousand rows, and some pathological
+// and invalid rows
+func DefaultOptions() Options {
+	return Options{
+		Agencies:          5,
+		FirstAgency:       1,
+		RowsPerAgency:     10000,
+		WinningNumber:     DefaultWinningNumber,
+		WinnerRatio:       0.001,
+		PathologicalRatio: 0.05,
+		InvalidRatio:      0.01,
+		Seed:              1,
+	}
+}
+
+// Validate Returns an error if the options cannot generate a dataset
+func (o Options) Validate() error {
+	rules := common.DefaultValidationRules()
+	switch {
+	case o.Agencies < 1:
+		return fmt.Errorf("invalid amount of agencies %d, it must be at least 1", o.Agencies)
+	case o.FirstAgency < 0:
+		return fmt.Errorf("invalid first agency %d, it must not be negative", o.FirstAgency)
+	case o.RowsPerAgency < 0:
+		return fmt.Errorf("invalid rows per agency %d, it must not be negative", o.RowsPerAgency)
+	case o.WinningNumber < int(rules.MinNumber) || o.WinningNumber > int(rules.MaxNumber):
+		return fmt.Errorf("invalid winning number %d, it must be between %d and %d", o.WinningNumber, rules.MinNumber, rules.MaxNumber)
+	}
+
+	for _, ratio := range []struct {
+		name  string
+		value float64
+	}{
+		{"winner", o.WinnerRatio},
+		{"pathological", o.PathologicalRatio},
+		{"invalid", o.InvalidRatio},
+	} {
+		if ratio.value < 0 || ratio.value > 1 {
+			return fmt.Errorf("invalid %v ratio %v, it must be between 0 and 1", ratio.name, ratio.value)
+		}
+	}
+	return nil
+}
+
+// AgencyManifest What the file of an agency holds
+type AgencyManifest struct {
+	Agency int    `json:"agency"`
+	File   string `json:"file"`
+	// Rows is the amount of csv records, Bets the valid ones among them and
+	// InvalidLines the line where each invalid one starts
+	Rows         int   `json:"rows"`
+	Bets         int   `json:"bets"`
+	InvalidLines []int `json:"invalidLines"`
+	// Winners are the documents of the valid bets of the winning number, in
+	// the order of the file
+	Winners []string `json:"winners"`
+}
+
+// Manifest What a generated dataset holds
+type Manifest struct {
+	Seed          int64            `json:"seed"`
+	WinningNumber int              `json:"winningNumber"`
+	Agencies      []AgencyManifest `json:"agencies"`
+}
+
+// AgencyFile Returns the name of the file of the agency
+func AgencyFile(agency int) string {
+	return fmt.Sprintf("agency-%d.csv", agency)
+}
+
+// Generate Writes the file of every agency and the manifest to dir, which is
+// created if missing. Returns the manifest
+func Generate(dir string, options Options) (*Manifest, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{Seed: options.Seed, WinningNumber: options.WinningNumber}
+	for i := 0; i < options.Agencies; i++ {
+		agency, err := generateFile(filepath.Join(dir, AgencyFile(options.FirstAgency+i)), options.FirstAgency+i, options)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Agencies = append(manifest.Agencies, agency)
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), append(encoded, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func generateFile(path string, agency int, options Options) (AgencyManifest, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return AgencyManifest{}, err
+	}
+
+	manifest, err := WriteAgency(file, agency, options)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return manifest, err
+}
+
+// WriteAgency Writes the rows of the agency to w. They are always the same
+// for a given seed and agency
+func WriteAgency(w io.Writer, agency int, options Options) (AgencyManifest, error) {
+	if err := options.Validate(); err != nil {
+		return AgencyManifest{}, err
+	}
+
+	generator := &rowGenerator{
+		rng:     rand.New(rand.NewSource(options.Seed*_AGENCY_SEED_STRIDE + int64(agency))),
+		options: options,
+	}
+	manifest := AgencyManifest{
+		Agency:       agency,
+		File:         AgencyFile(agency),
+		Rows:         options.RowsPerAgency,
+		InvalidLines: []int{},
+		Winners:      []string{},
+	}
+
+	// Each row is written on its own to count the lines it spans
+	var row bytes.Buffer
+	writer := csv.NewWriter(&row)
+	line := 1
+	for i := 0; i < options.RowsPerAgency; i++ {
+		record, valid := generator.next()
+		switch {
+		case !valid:
+			manifest.InvalidLines = append(manifest.InvalidLines, line)
+		case record[4] == fmt.Sprint(options.WinningNumber):
+			manifest.Winners = append(manifest.Winners, record[2])
+			manifest.Bets++
+		default:
+			manifest.Bets++
+		}
+
+		row.Reset()
+		writer.Write(record)
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return manifest, err
+		}
+		line += bytes.Count(row.Bytes(), []byte("\n"))
+		if _, err := w.Write(row.Bytes()); err != nil {
+			return manifest, err
+		}
+	}
+	return manifest, nil
+}
+
+// ReadManifest Reads the manifest of the dataset in dir
+func ReadManifest(dir string) (*Manifest, error) {
+	encoded, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(encoded, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// Agency Returns the manifest of the agency
+func (m *Manifest) Agency(agency int) (AgencyManifest, error) {
+	for _, manifest := range m.Agencies {
+		if manifest.Agency == agency {
+			return manifest, nil
+		}
+	}
+	return AgencyManifest{}, fmt.Errorf("agency %d is not in the manifest", agency)
+}
+
+var firstNames = []string{"Santiago Lionel", "Valentina", "Juan", "Ana Laura", "José", "Lucía", "Martín", "Sofía", "Mateo", "Martina"}
+var lastNames = []string{"Lorca", "Vera", "Álvarez", "Borges", "González", "Rodríguez", "Fernández", "López", "Pérez", "Gómez"}
+
+// pathologicalNames Valid names that are hard to handle: non ASCII text,
+// combining and wide characters, the separators of the csv and of the
+// winners list, surrounding spaces and spreadsheet formulas
+var pathologicalNames = []string{
+	"Zoë Ñúñez",
+	"Łukasz Żółć",
+	"Ørjan Ærø",
+	"李小龍",
+	"محمد",
+	"Ana 🎉",
+	"José",
+	"Lorca, Santiago",
+	`Juan "Pepe"`,
+	"Pérez;Gómez",
+	"Ana|María",
+	"U$S",
+	"Ana\tMaría",
+	"Ana\nMaría",
+	" Ana ",
+	"=SUM(A1)",
+}
+
+// valid birthdates, within the default rules no matter the current date
+var minBirthdate = time.Date(1930, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const _BIRTHDATE_DAYS = 75 * 365
+
+// rowGenerator Generates the rows of an agency
+type rowGenerator struct {
+	rng     *rand.Rand
+	options Options
+}
+
+// next Returns the next row and whether it is valid
+func (g *rowGenerator) next() ([]string, bool) {
+	rules := common.DefaultValidationRules()
+
+	number := g.options.WinningNumber
+	if g.rng.Float64() >= g.options.WinnerRatio {
+		for number == g.options.WinningNumber {
+			number = int(rules.MinNumber) + g.rng.Intn(int(rules.MaxNumber-rules.MinNumber)+1)
+		}
+	}
+
+	record := []string{
+		firstNames[g.rng.Intn(len(firstNames))],
+		lastNames[g.rng.Intn(len(lastNames))],
+		fmt.Sprint(10000000 + g.rng.Intn(90000000)),
+		minBirthdate.AddDate(0, 0, g.rng.Intn(_BIRTHDATE_DAYS)).Format("2006-01-02"),
+		fmt.Sprint(number),
+	}
+
+	if g.rng.Float64() < g.options.PathologicalRatio {
+		record[g.rng.Intn(2)] = g.pathologicalName(rules.MaxFieldLength)
+	}
+
+	if g.rng.Float64() < g.options.InvalidRatio {
+		return invalidations[g.rng.Intn(len(invalidations))](record, rules), false
+	}
+	return record, true
+}
+
+// pathologicalName Returns a valid name that is hard to handle
+func (g *rowGenerator) pathologicalName(maxLength int) string {
+	switch choice := g.rng.Intn(len(pathologicalNames) + 2); choice {
+	case len(pathologicalNames):
+		// As long as allowed, taking twice as many bytes
+		return strings.Repeat("ñ", maxLength)
+	case len(pathologicalNames) + 1:
+		return longName(maxLength)
+	default:
+		return pathologicalNames[choice]
+	}
+}
+
+// longName Returns a name of length characters made of last names, ending
+// in a letter
+func longName(length int) string {
+	name := []rune(strings.Repeat("Pérez González ", length))
+	return string(name[:length-1]) + "z"
+}
+
+// invalidations Turn a valid row into one breaking a single rule
+var invalidations = []func(record []string, rules common.ValidationRules) []string{
+	func(record []string, rules common.ValidationRules) []string {
+		record[0] = "   "
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[1] = longName(rules.MaxFieldLength + 1)
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[1] = "Lorca\xff"
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[2] = "30.904.465"
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[2] = fmt.Sprint(rules.MaxDocument + 1)
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[3] = "1999-02-30"
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[3] = "17/03/1999"
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[3] = rules.MinBirthdate.AddDate(0, 0, -1).Format("2006-01-02")
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[3] = "2999-01-01"
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[4] = fmt.Sprint(rules.MaxNumber + 1)
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[4] = "-1"
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		record[4] = "siete mil"
+		return record
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		return record[:4]
+	},
+	func(record []string, rules common.ValidationRules) []string {
+		return append(record, "extra")
+	},
+}
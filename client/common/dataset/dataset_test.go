@@ -0,0 +1,198 @@
+package dataset_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/dataset"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/fakeserver"
+)
+
+// testOptions Returns the options of a small dataset where every kind of row
+// is frequent
+func testOptions() dataset.Options {
+	options := dataset.DefaultOptions()
+	options.Agencies = 3
+	options.RowsPerAgency = 1000
+	options.WinnerRatio = 0.05
+	options.PathologicalRatio = 0.3
+	options.InvalidRatio = 0.1
+	options.Seed = 42
+	return options
+}
+
+// quarantinedLines Returns the lines of the rows the client quarantined
+func quarantinedLines(t *testing.T, path string) []int {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []int{}
+	for _, record := range records[1:] {
+		line, err := strconv.Atoi(record[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestUploadedDatasetMatchesManifest(t *testing.T) {
+	dir := t.TempDir()
+	options := testOptions()
+	manifest, err := dataset.Generate(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := fakeserver.Start(fakeserver.Options{Agencies: options.Agencies, WinningNumber: options.WinningNumber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, agency := range manifest.Agencies {
+		quarantine := filepath.Join(dir, fmt.Sprintf("quarantine-%d.csv", agency.Agency))
+		config := common.ClientConfig{
+			ID:               fmt.Sprint(agency.Agency),
+			ServerAddress:    server.Addr(),
+			BetsFiles:        filepath.Join(dir, agency.File),
+			CSV:              common.DefaultCSVOptions(),
+			ValidationRules:  common.DefaultValidationRules(),
+			ValidationMode:   common.ValidationQuarantine,
+			QuarantineFile:   quarantine,
+			MaxRejectRatio:   1,
+			BatchAmount:      100,
+			BatchMaxSize:     64 * 1024,
+			BatchWindow:      4,
+			ResumeMaxRetries: 1,
+			Retry:            common.RetryPolicy{InitialDelay: 10 * time.Millisecond, Multiplier: 1, MaxDelay: 10 * time.Millisecond, MaxAttempts: 500},
+			Timeouts:         common.Timeouts{Connect: time.Second, Write: time.Second, Ack: time.Second, Results: time.Second},
+		}
+
+		// Every agency but the last one waits for the raffle
+		done := make(chan error, 1)
+		go func() { done <- common.NewClient(config).Start(context.Background()) }()
+		if agency.Agency == manifest.Agencies[len(manifest.Agencies)-1].Agency {
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			defer func() {
+				if err := <-done; err != nil {
+					t.Error(err)
+				}
+			}()
+			for deadline := time.Now().Add(5 * time.Second); !server.Completed(uint32(agency.Agency)); time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("agency %d did not complete its upload", agency.Agency)
+				}
+			}
+		}
+
+		if lines := quarantinedLines(t, quarantine); !reflect.DeepEqual(lines, agency.InvalidLines) {
+			t.Fatalf("agency %d: expected lines %v to be quarantined, got %v", agency.Agency, agency.InvalidLines, lines)
+		}
+	}
+
+	stored := make(map[string]int)
+	for _, bet := range server.Bets() {
+		stored[bet.Agency]++
+	}
+	for _, agency := range manifest.Agencies {
+		if stored[fmt.Sprint(agency.Agency)] != agency.Bets {
+			t.Fatalf("agency %d: expected %d bets stored, got %d", agency.Agency, agency.Bets, stored[fmt.Sprint(agency.Agency)])
+		}
+		if len(agency.Winners) == 0 || len(agency.InvalidLines) == 0 {
+			t.Fatalf("agency %d: expected winners and invalid rows, got %+v", agency.Agency, agency)
+		}
+		// The fake server sorts the winners it reports
+		expected := append([]string(nil), agency.Winners...)
+		sort.Strings(expected)
+		if winners := server.Winners(uint32(agency.Agency)); !reflect.DeepEqual(winners, expected) {
+			t.Fatalf("agency %d: expected winners %v, got %v", agency.Agency, expected, winners)
+		}
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	options := testOptions()
+
+	var first, second, other bytes.Buffer
+	if _, err := dataset.WriteAgency(&first, 1, options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataset.WriteAgency(&second, 1, options); err != nil {
+		t.Fatal(err)
+	}
+	options.Seed++
+	if _, err := dataset.WriteAgency(&other, 1, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatal("expected the same rows for the same seed")
+	}
+	if bytes.Equal(first.Bytes(), other.Bytes()) {
+		t.Fatal("expected different rows for a different seed")
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	options := testOptions()
+	options.FirstAgency = 7
+	generated, err := dataset.Generate(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := dataset.ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, generated) {
+		t.Fatalf("expected %+v, got %+v", generated, read)
+	}
+
+	if _, err := read.Agency(8); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read.Agency(1); err == nil {
+		t.Fatal("expected agency 1 not to be in the manifest")
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, change := range []func(*dataset.Options){
+		func(o *dataset.Options) { o.Agencies = 0 },
+		func(o *dataset.Options) { o.WinningNumber = 10000 },
+		func(o *dataset.Options) { o.InvalidRatio = 1.5 },
+	} {
+		options := testOptions()
+		change(&options)
+		if _, err := dataset.Generate(t.TempDir(), options); err == nil {
+			t.Fatalf("expected %+v to be rejected", options)
+		}
+	}
+}
@@ -0,0 +1,668 @@
+package fakeserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const _SENDING_BETS = 0
+const _BATCH_RECEIVED = 1
+const _REQUEST_RESULTS = 2
+const _RESULTS_NOT_READY = 3
+const _SENDING_RESULTS = 4
+const _ERROR_CODE = 5
+const _HELLO = 6
+const _HELLO_ACK = 7
+const _BATCH_ALREADY_STORED = 8
+const _AUTH = 9
+const _AUTH_CHALLENGE = 10
+const _AUTH_OK = 11
+const _BATCH_CORRUPTED = 12
+
+const _PROTOCOL_VERSION = 2
+const _LEGACY_PROTOCOL_VERSION = 1
+const _LEGACY_FEATURES = FeatureWideIds
+
+const _FRAME_VERSION = 1
+const _FRAME_HEADER_SIZE = 5
+const _BET_FIELDS = 6
+const _FIELD_LENGTH_SIZE = 2
+const _WINNER_SEPARATOR = "$"
+
+const _CODEC_NONE = 0
+const _CODEC_GZIP = 1
+const _CHECKSUM_SIZE = 4
+const _NOT_APPLICABLE = 0xFFFFFFFF
+const _MAX_ERROR_MESSAGE_SIZE = 0xFFFF
+
+const _AUTH_NONCE_SIZE = 32
+const _AUTH_MAC_SIZE = sha256.Size
+
+const _UPLOAD_NOT_STARTED = 0
+const _UPLOAD_IN_PROGRESS = 1
+const _UPLOAD_COMPLETED = 2
+
+// errChecksumMismatch A batch arrived corrupted, which is answered with
+// _BATCH_CORRUPTED instead of an error
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// errDisconnect Closes the connection without answering
+var errDisconnect = errors.New("disconnected by fault")
+
+// connection Serves a single client connection, as the handler of the real
+// server does
+type connection struct {
+	server       *Server
+	conn         net.Conn
+	number       int
+	version      uint8
+	features     uint32
+	maxFrameSize uint32
+	// agency proven by the client, if it authenticated
+	authenticated    uint32
+	hasAuthenticated bool
+}
+
+func newConnection(server *Server, conn net.Conn, number int) *connection {
+	return &connection{
+		server:       server,
+		conn:         conn,
+		number:       number,
+		version:      _LEGACY_PROTOCOL_VERSION,
+		features:     _LEGACY_FEATURES,
+		maxFrameSize: server.options.MaxFrameSize,
+	}
+}
+
+// serve Handles the request of the client, answering the error that
+// interrupted it if any
+func (c *connection) serve() {
+	err := c.handle()
+
+	var protocolErr *Error
+	switch {
+	case errors.As(err, &protocolErr):
+		c.sendError(protocolErr)
+	case errors.Is(err, errChecksumMismatch):
+		c.conn.Write([]byte{_BATCH_CORRUPTED})
+	}
+}
+
+func (c *connection) handle() error {
+	action, err := c.receiveByte()
+	if err != nil {
+		return err
+	}
+
+	if action == _HELLO {
+		if c.server.options.Legacy {
+			// The rest of the HELLO is read, so the connection is closed
+			// cleanly instead of reset
+			if _, err := c.receive(5); err != nil {
+				return err
+			}
+			return errDisconnect
+		}
+		if err := c.handshake(); err != nil {
+			return err
+		}
+		if c.authenticationRequired() {
+			if err := c.authenticate(); err != nil {
+				return err
+			}
+		}
+		if action, err = c.receiveByte(); err != nil {
+			return err
+		}
+	} else if c.authenticationRequired() {
+		return NewError(ErrorAuthenticationFailed, "Legacy clients cannot authenticate")
+	}
+
+	switch action {
+	case _SENDING_BETS:
+		return c.handleSendingBets()
+	case _REQUEST_RESULTS:
+		return c.handleRequestResults()
+	default:
+		return NewError(ErrorMalformedMessage, "Unknown action %d", action)
+	}
+}
+
+func (c *connection) authenticationRequired() bool {
+	return len(c.server.options.Secrets) > 0
+}
+
+func (c *connection) supports(feature uint32) bool {
+	return c.features&feature != 0
+}
+
+func (c *connection) sequenced() bool {
+	return c.supports(FeaturePipelining | FeatureResumableUpload | FeatureIdempotentBatches)
+}
+
+// handshake Answers the version and features advertised by the client with
+// the ones that will be used
+func (c *connection) handshake() error {
+	hello, err := c.receive(5)
+	if err != nil {
+		return err
+	}
+
+	if c.hooks().Handshake != nil {
+		if err := c.applyFault(c.hooks().Handshake(c.number)); err != nil {
+			return err
+		}
+	}
+
+	clientVersion := hello[0]
+	if clientVersion < _LEGACY_PROTOCOL_VERSION {
+		return NewError(ErrorMalformedMessage, "Unsupported protocol version: %d", clientVersion)
+	}
+
+	supported := uint32(AllFeatures)
+	if c.authenticationRequired() {
+		supported |= FeatureAuthentication
+	}
+	supported &^= c.server.options.DisabledFeatures
+
+	version := uint8(_PROTOCOL_VERSION)
+	if clientVersion < version {
+		version = clientVersion
+	}
+	features := binary.BigEndian.Uint32(hello[1:]) & supported
+	if version == _LEGACY_PROTOCOL_VERSION {
+		features = _LEGACY_FEATURES
+	}
+
+	// The client expects a bare error until the handshake is answered
+	if c.authenticationRequired() && features&FeatureAuthentication == 0 {
+		return NewError(ErrorAuthenticationFailed, "Client does not support authentication")
+	}
+
+	c.version, c.features = version, features
+	reply := []byte{_HELLO_ACK, version}
+	return c.send(append(reply, uint32ToBytes(features)...))
+}
+
+// authenticate Challenges the client to prove it knows the secret of the
+// agency it claims to be
+func (c *connection) authenticate() error {
+	action, err := c.receiveByte()
+	if err != nil {
+		return err
+	}
+	if action != _AUTH {
+		return NewError(ErrorAuthenticationFailed, "Client did not authenticate")
+	}
+
+	agency, err := c.receiveUint32()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, _AUTH_NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := c.send(append([]byte{_AUTH_CHALLENGE}, nonce...)); err != nil {
+		return err
+	}
+
+	answer, err := c.receive(_AUTH_MAC_SIZE)
+	if err != nil {
+		return err
+	}
+
+	secret, ok := c.server.options.Secrets[agency]
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write(uint32ToBytes(agency))
+	if !ok || !hmac.Equal(answer, mac.Sum(nil)) {
+		return NewError(ErrorAuthenticationFailed, "Authentication failed for agency %d", agency)
+	}
+
+	c.authenticated, c.hasAuthenticated = agency, true
+	return c.send([]byte{_AUTH_OK})
+}
+
+func (c *connection) handleSendingBets() error {
+	requested, err := c.receiveUint32()
+	if err != nil {
+		return err
+	}
+	if requested == 0 {
+		return NewError(ErrorMalformedMessage, "Invalid max frame size requested")
+	}
+	if requested < c.maxFrameSize {
+		c.maxFrameSize = requested
+	}
+	if err := c.send(uint32ToBytes(c.maxFrameSize)); err != nil {
+		return err
+	}
+
+	agency, hasAgency := c.authenticated, c.hasAuthenticated
+	if c.supports(FeatureResumableUpload) {
+		if agency, err = c.receiveUint32(); err != nil {
+			return err
+		}
+		hasAgency = true
+		if err := c.checkAgency(agency, -1, 0, false); err != nil {
+			return err
+		}
+
+		completed, lastSeq, hasSeq := c.server.uploadStatus(agency)
+		status := byte(_UPLOAD_NOT_STARTED)
+		if completed {
+			status = _UPLOAD_COMPLETED
+		} else if hasSeq {
+			status = _UPLOAD_IN_PROGRESS
+		}
+		if err := c.send(append([]byte{status}, uint32ToBytes(lastSeq)...)); err != nil {
+			return err
+		}
+		if completed {
+			return nil
+		}
+	}
+
+	for position := uint32(0); ; position++ {
+		batch, err := c.receiveBatch(position)
+		if err != nil {
+			return err
+		}
+
+		if len(batch.Bets) == 0 {
+			c.server.complete(agency, hasAgency)
+			return nil
+		}
+
+		if batch.HasAgency {
+			if hasAgency && batch.Agency != agency {
+				err := NewError(ErrorAgencyMismatch, "Batch from agency %d received in upload of agency %d", batch.Agency, agency)
+				err.Seq, err.HasSeq = batch.Seq, true
+				return err
+			}
+			agency, hasAgency = batch.Agency, true
+		} else if hasAgency {
+			batch.Agency, batch.HasAgency = agency, true
+		}
+
+		for i, bet := range batch.Bets {
+			betAgency, _ := strconv.ParseUint(bet.Agency, 10, 32)
+			if err := c.checkAgency(uint32(betAgency), i, batch.Seq, c.sequenced()); err != nil {
+				return err
+			}
+		}
+
+		fault := Fault{}
+		if c.hooks().Batch != nil {
+			fault = c.hooks().Batch(batch)
+		}
+		if err := c.applyFault(fault); err != nil {
+			return err
+		}
+
+		stored, err := c.server.store(batch, c.supports(FeatureIdempotentBatches))
+		if err != nil {
+			return err
+		}
+		if fault.DisconnectAfterStore {
+			return errDisconnect
+		}
+
+		code := byte(_BATCH_RECEIVED)
+		if !stored {
+			code = _BATCH_ALREADY_STORED
+		}
+		ack := []byte{code}
+		if c.sequenced() {
+			ack = append(ack, uint32ToBytes(batch.Seq)...)
+		}
+		if err := c.send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// checkAgency Checks an authenticated client only acts on behalf of its own
+// agency
+func (c *connection) checkAgency(agency uint32, betIndex int, seq uint32, hasSeq bool) error {
+	if !c.hasAuthenticated || agency == c.authenticated {
+		return nil
+	}
+	err := NewError(ErrorAgencyMismatch, "Agency %d cannot act on behalf of agency %d", c.authenticated, agency)
+	err.Seq, err.HasSeq, err.BetIndex = seq, hasSeq, betIndex
+	return err
+}
+
+// receiveBatch Receives and decodes a batch frame. A batch without bets
+// means the client finished sending them
+func (c *connection) receiveBatch(position uint32) (Batch, error) {
+	batch := Batch{Connection: c.number, Seq: position}
+
+	if c.hooks().BatchFrame != nil {
+		fault := c.hooks().BatchFrame(c.number, position)
+		if fault.DisconnectAfterBytes > 0 {
+			if _, err := c.receive(fault.DisconnectAfterBytes); err != nil {
+				return batch, err
+			}
+			return batch, errDisconnect
+		}
+		if err := c.applyFault(fault); err != nil {
+			return batch, err
+		}
+	}
+
+	payload, err := c.receiveFrame()
+	if err != nil || len(payload) == 0 {
+		return batch, err
+	}
+
+	if c.supports(FeatureChecksums) {
+		if payload, err = verifyChecksum(payload); err != nil {
+			return batch, err
+		}
+	}
+	if c.supports(FeatureCompression) {
+		if payload, err = decodePayload(payload, c.maxFrameSize); err != nil {
+			return batch, NewError(ErrorMalformedMessage, "%v", err)
+		}
+	}
+
+	if c.supports(FeatureIdempotentBatches) {
+		if len(payload) < 4 {
+			return batch, NewError(ErrorMalformedMessage, "Batch without id")
+		}
+		batch.Agency, batch.HasAgency = binary.BigEndian.Uint32(payload), true
+		payload = payload[4:]
+	}
+
+	hasSeq := c.sequenced()
+	if hasSeq {
+		if len(payload) < 4 {
+			return batch, NewError(ErrorMalformedMessage, "Batch without sequence number")
+		}
+		batch.Seq = binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+	}
+
+	for len(payload) > 0 {
+		var bet *Bet
+		bet, payload = decodeBet(payload)
+		if bet == nil {
+			err := NewError(ErrorMalformedMessage, "Truncated bet")
+			err.Seq, err.HasSeq, err.BetIndex = batch.Seq, hasSeq, len(batch.Bets)
+			return batch, err
+		}
+		if reason := validateBet(bet); reason != nil {
+			err := NewError(ErrorInvalidBet, "Invalid bet: %v", reason)
+			err.Seq, err.HasSeq, err.BetIndex = batch.Seq, hasSeq, len(batch.Bets)
+			return batch, err
+		}
+		batch.Bets = append(batch.Bets, *bet)
+	}
+	return batch, nil
+}
+
+// decodeBet Decodes the length-prefixed fields of the bet at the start of
+// data, returning it and the rest of data, or nil if it is truncated
+func decodeBet(data []byte) (*Bet, []byte) {
+	fields := make([]string, 0, _BET_FIELDS)
+	for i := 0; i < _BET_FIELDS; i++ {
+		if len(data) < _FIELD_LENGTH_SIZE {
+			return nil, data
+		}
+		length := int(binary.BigEndian.Uint16(data))
+		data = data[_FIELD_LENGTH_SIZE:]
+		if len(data) < length {
+			return nil, data
+		}
+		fields = append(fields, string(data[:length]))
+		data = data[length:]
+	}
+
+	return &Bet{
+		Agency:    fields[0],
+		FirstName: fields[1],
+		LastName:  fields[2],
+		Document:  fields[3],
+		Birthdate: fields[4],
+		Number:    fields[5],
+	}, data
+}
+
+// validateBet Checks the bet can be stored, as the real server does
+func validateBet(bet *Bet) error {
+	for _, field := range []string{bet.Agency, bet.FirstName, bet.LastName, bet.Document, bet.Birthdate, bet.Number} {
+		if !utf8.ValidString(field) {
+			return fmt.Errorf("field %q is not valid UTF-8", field)
+		}
+	}
+	if _, err := strconv.Atoi(bet.Agency); err != nil {
+		return fmt.Errorf("invalid agency %q", bet.Agency)
+	}
+	if _, err := time.Parse("2006-01-02", bet.Birthdate); err != nil {
+		return fmt.Errorf("invalid birthdate %q", bet.Birthdate)
+	}
+	if _, err := strconv.Atoi(bet.Number); err != nil {
+		return fmt.Errorf("invalid number %q", bet.Number)
+	}
+	return nil
+}
+
+func (c *connection) handleRequestResults() error {
+	var agency uint32
+	if c.supports(FeatureWideIds) {
+		var err error
+		if agency, err = c.receiveUint32(); err != nil {
+			return err
+		}
+	} else {
+		id, err := c.receiveByte()
+		if err != nil {
+			return err
+		}
+		agency = uint32(id)
+	}
+	if err := c.checkAgency(agency, -1, 0, false); err != nil {
+		return err
+	}
+
+	request, winners, ready := c.server.results(agency)
+	fault := Fault{}
+	if c.hooks().Results != nil {
+		fault = c.hooks().Results(agency, request)
+	}
+	if err := c.applyFault(fault); err != nil {
+		return err
+	}
+
+	if fault.NotReady || !ready {
+		return c.send([]byte{_RESULTS_NOT_READY})
+	}
+
+	payload := []byte(strings.Join(winners, _WINNER_SEPARATOR))
+	if c.supports(FeatureCompression) && len(payload) > 0 {
+		payload = encodePayload(payload)
+	}
+	if c.supports(FeatureChecksums) && len(payload) > 0 {
+		payload = append(payload, uint32ToBytes(crc32.ChecksumIEEE(payload))...)
+	}
+
+	reply := []byte{_SENDING_RESULTS, _FRAME_VERSION}
+	reply = append(reply, uint32ToBytes(uint32(len(payload)))...)
+	return c.send(append(reply, payload...))
+}
+
+func (c *connection) hooks() Hooks {
+	return c.server.options.Hooks
+}
+
+// applyFault Waits the delay of the fault and returns the error that
+// interrupts the request, if any
+func (c *connection) applyFault(fault Fault) error {
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	if fault.Error != nil {
+		return fault.Error
+	}
+	if fault.Disconnect {
+		return errDisconnect
+	}
+	return nil
+}
+
+// sendError Reports the error to the client, with its details if structured
+// errors were negotiated
+func (c *connection) sendError(err *Error) {
+	buf := []byte{_ERROR_CODE}
+	if c.supports(FeatureStructuredErrors) {
+		seq, index := uint32(_NOT_APPLICABLE), uint32(_NOT_APPLICABLE)
+		if err.HasSeq {
+			seq = err.Seq
+		}
+		if err.BetIndex >= 0 {
+			index = uint32(err.BetIndex)
+		}
+		message := err.Message
+		if len(message) > _MAX_ERROR_MESSAGE_SIZE {
+			// Cut at the start of a character, so none is split
+			end := _MAX_ERROR_MESSAGE_SIZE
+			for end > 0 && !utf8.RuneStart(message[end]) {
+				end--
+			}
+			message = message[:end]
+		}
+
+		buf = append(buf, byte(err.Code))
+		buf = append(buf, uint32ToBytes(seq)...)
+		buf = append(buf, uint32ToBytes(index)...)
+		buf = append(buf, byte(len(message)>>8), byte(len(message)))
+		buf = append(buf, message...)
+	}
+	c.send(buf)
+}
+
+// receiveFrame Receives a frame and returns its payload
+func (c *connection) receiveFrame() ([]byte, error) {
+	header, err := c.receive(_FRAME_HEADER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != _FRAME_VERSION {
+		return nil, NewError(ErrorMalformedMessage, "Unsupported frame version: %d", header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > c.maxFrameSize {
+		return nil, NewError(ErrorMalformedMessage, "Frame of %d bytes exceeds max frame size of %d bytes", length, c.maxFrameSize)
+	}
+	return c.receive(int(length))
+}
+
+func (c *connection) receive(size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c *connection) receiveByte() (byte, error) {
+	buf, err := c.receive(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (c *connection) receiveUint32() (uint32, error) {
+	buf, err := c.receive(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+func (c *connection) send(data []byte) error {
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func uint32ToBytes(value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return buf
+}
+
+// verifyChecksum Returns the payload without its checksum
+func verifyChecksum(payload []byte) ([]byte, error) {
+	if len(payload) < _CHECKSUM_SIZE {
+		return nil, fmt.Errorf("%w: frame of %d bytes can not hold a checksum", errChecksumMismatch, len(payload))
+	}
+	data := payload[:len(payload)-_CHECKSUM_SIZE]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(payload[len(data):]) {
+		return nil, errChecksumMismatch
+	}
+	return data, nil
+}
+
+// encodePayload Prefixes the payload with its codec, compressing it only if
+// that makes it smaller
+func encodePayload(payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(_CODEC_GZIP)
+	writer := gzip.NewWriter(&buf)
+	writer.Write(payload)
+	writer.Close()
+
+	if buf.Len() < 1+len(payload) {
+		return buf.Bytes()
+	}
+	return append([]byte{_CODEC_NONE}, payload...)
+}
+
+// decodePayload Decodes a payload prefixed by its codec, which can not be
+// longer than maxSize once decoded
+func decodePayload(payload []byte, maxSize uint32) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("Frame without codec")
+	}
+
+	codec, data := payload[0], payload[1:]
+	switch codec {
+	case _CODEC_NONE:
+		return data, nil
+	case _CODEC_GZIP:
+	default:
+		return nil, fmt.Errorf("Unsupported codec: %d", codec)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid compressed frame: %v", err)
+	}
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid compressed frame: %v", err)
+	}
+	if uint64(len(decoded)) > uint64(maxSize) {
+		return nil, fmt.Errorf("Decompressed frame exceeds max frame size of %d bytes", maxSize)
+	}
+	return decoded, nil
+}
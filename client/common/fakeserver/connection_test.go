@@ -0,0 +1,18 @@
+package fakeserver
+
+import (
+	"testing"
+)
+
+func TestDecodePayloadWithoutCodec(t *testing.T) {
+	// A frame made of just the checksum of no bytes, which is 0, leaves an
+	// empty payload to decode
+	payload, err := verifyChecksum([]byte{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decodePayload(payload, 1024); err == nil {
+		t.Fatal("expected a payload without codec to be rejected")
+	}
+}
@@ -0,0 +1,400 @@
+// Package fakeserver implements the server side of the lottery protocol on a
+// loopback listener, so the client can be tested without the Python server.
+// It stores the bets in memory and performs the raffle once every agency
+// finished its upload, as the real server does, and lets tests inject
+// delays, errors, disconnects and unready results through Hooks
+package fakeserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Features the server can negotiate in the handshake, as advertised on the
+// wire
+const (
+	FeatureWideIds           = 1 << 0
+	FeatureCompression       = 1 << 1
+	FeatureResumableUpload   = 1 << 2
+	FeaturePipelining        = 1 << 3
+	FeatureIdempotentBatches = 1 << 4
+	FeatureAuthentication    = 1 << 5
+	FeatureChecksums         = 1 << 6
+	FeatureStructuredErrors  = 1 << 7
+)
+
+// AllFeatures are the features the server supports unless disabled.
+// Authentication is only negotiated if the server has agency secrets
+const AllFeatures = FeatureWideIds | FeatureCompression | FeatureResumableUpload | FeaturePipelining |
+	FeatureIdempotentBatches | FeatureChecksums | FeatureStructuredErrors
+
+// DefaultMaxFrameSize is the frame size of the real server
+const DefaultMaxFrameSize = 1048576
+
+// DefaultWinningNumber is the number that wins the raffle
+const DefaultWinningNumber = 7574
+
+// ErrorCode Identifies why the server rejected a request
+type ErrorCode uint8
+
+const (
+	ErrorUnknown ErrorCode = iota
+	ErrorMalformedMessage
+	ErrorInvalidBet
+	ErrorOutOfOrderBatch
+	ErrorAgencyMismatch
+	ErrorAuthenticationFailed
+)
+
+// Error An error reported to the client with _ERROR_CODE. Its details are
+// only sent if structured errors were negotiated
+type Error struct {
+	Code ErrorCode
+	// Seq is the sequence number of the batch the error refers to, if HasSeq
+	Seq    uint32
+	HasSeq bool
+	// BetIndex is the position of the bet within the batch the error refers
+	// to, or -1 if it does not refer to a single bet
+	BetIndex int
+	Message  string
+}
+
+// NewError Returns an error that does not refer to any batch
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, BetIndex: -1, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error %d: %v", e.Code, e.Message)
+}
+
+// Bet A bet as received by the server
+type Bet struct {
+	Agency    string
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate string
+	Number    string
+}
+
+// Batch A batch of bets received by the server
+type Batch struct {
+	// Connection is the number of the connection it was received in,
+	// starting from 1
+	Connection int
+	// Agency is the agency uploading the batch, if HasAgency. It is unknown
+	// to servers without resumable uploads nor idempotent batches
+	Agency    uint32
+	HasAgency bool
+	// Seq is the sequence number of the batch, or the position of the batch
+	// within the connection if batches are not sequenced
+	Seq  uint32
+	Bets []Bet
+}
+
+// Fault What the server does instead of answering a request as usual. The
+// zero value answers it as usual
+type Fault struct {
+	// Delay is how long the server waits before answering
+	Delay time.Duration
+	// Error is answered instead of the reply, closing the connection
+	Error *Error
+	// Disconnect closes the connection without answering. A batch is
+	// discarded, and the batches sent after it are left unread
+	Disconnect bool
+	// DisconnectAfterStore stores a batch before closing the connection
+	// without acknowledging it
+	DisconnectAfterStore bool
+	// DisconnectAfterBytes closes the connection once that many bytes of a
+	// batch frame were received, as if it dropped in the middle of the frame.
+	// Only applies to the faults of the BatchFrame hook
+	DisconnectAfterBytes int
+	// NotReady answers a winners request with _RESULTS_NOT_READY, even if
+	// the raffle was performed
+	NotReady bool
+}
+
+// Hooks Decide the fault of each request. Nil hooks answer every request as
+// usual. They are called from the goroutine serving each connection, so
+// they may be called concurrently
+type Hooks struct {
+	// Handshake is called before answering the handshake of each connection
+	Handshake func(connection int) Fault
+	// BatchFrame is called before receiving each batch frame, being position
+	// the amount of batch frames received before in the connection
+	BatchFrame func(connection int, position uint32) Fault
+	// Batch is called once a batch is received and decoded, before it is
+	// stored
+	Batch func(batch Batch) Fault
+	// Results is called for every winners request, being request the amount
+	// of requests of the agency so far, starting from 1
+	Results func(agency uint32, request int) Fault
+}
+
+// Options How the server behaves. The zero value speaks the latest version
+// of the protocol with every feature, and performs the raffle once a single
+// agency finished its upload
+type Options struct {
+	// Agencies is the amount of agencies that must finish their uploads
+	// before the raffle. Zero means 1
+	Agencies int
+	// DisabledFeatures are not negotiated even if the client supports them
+	DisabledFeatures uint32
+	// Legacy makes the server close the connection on a handshake, as servers
+	// that only speak the first version of the protocol do
+	Legacy bool
+	// MaxFrameSize is the largest frame accepted. Zero means
+	// DefaultMaxFrameSize
+	MaxFrameSize uint32
+	// Secrets are the secrets of the agencies. If there are any, agencies
+	// must authenticate
+	Secrets map[uint32][]byte
+	// WinningNumber is the number that wins the raffle. Zero means
+	// DefaultWinningNumber
+	WinningNumber int
+	Hooks         Hooks
+}
+
+// upload The progress of the upload of an agency
+type upload struct {
+	lastSeq   uint32
+	hasSeq    bool
+	completed bool
+}
+
+// Server A fake lottery server listening on loopback
+type Server struct {
+	options  Options
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu          sync.Mutex
+	conns       map[net.Conn]struct{}
+	connections int
+	bets        []Bet
+	uploads     map[uint32]*upload
+	processed   int
+	raffled     bool
+	winners     map[uint32][]string
+	requests    map[uint32]int
+}
+
+// Start Starts a server listening on a random loopback port
+func Start(options Options) (*Server, error) {
+	if options.Agencies == 0 {
+		options.Agencies = 1
+	}
+	if options.MaxFrameSize == 0 {
+		options.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if options.WinningNumber == 0 {
+		options.WinningNumber = DefaultWinningNumber
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		options:  options,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+		uploads:  make(map[uint32]*upload),
+		winners:  make(map[uint32][]string),
+		requests: make(map[uint32]int),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr Returns the address the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close Stops accepting connections, closes the open ones and waits for
+// them to finish
+func (s *Server) Close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connections++
+		number := s.connections
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			newConnection(s, conn, number).serve()
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Connections Returns the amount of connections accepted so far
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// Bets Returns the bets stored so far, in the order they were received
+func (s *Server) Bets() []Bet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Bet(nil), s.bets...)
+}
+
+// Completed Returns true if the agency finished its upload. Only known if
+// the agency identified itself with resumable uploads or idempotent batches
+func (s *Server) Completed(agency uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[agency]
+	return ok && upload.completed
+}
+
+// Raffled Returns true once every agency finished its upload and the raffle
+// was performed
+func (s *Server) Raffled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.raffled
+}
+
+// Winners Returns the documents of the winners of the agency, sorted
+func (s *Server) Winners(agency uint32) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	winners := append([]string(nil), s.winners[agency]...)
+	sort.Strings(winners)
+	return winners
+}
+
+// ResultsRequests Returns the amount of winners requests of the agency
+func (s *Server) ResultsRequests(agency uint32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[agency]
+}
+
+// uploadStatus Returns whether the upload of the agency is completed and
+// the last batch stored from it, if any
+func (s *Server) uploadStatus(agency uint32) (bool, uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[agency]
+	if !ok {
+		return false, 0, false
+	}
+	return upload.completed, upload.lastSeq, upload.hasSeq
+}
+
+// store Stores the batch, checking it follows the last one stored from its
+// agency if known. Returns false if batches are idempotent and it was
+// already stored
+func (s *Server) store(batch Batch, idempotent bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if batch.HasAgency {
+		upload := s.upload(batch.Agency)
+		if idempotent && upload.hasSeq && batch.Seq <= upload.lastSeq {
+			return false, nil
+		}
+
+		expected := uint32(0)
+		if upload.hasSeq {
+			expected = upload.lastSeq + 1
+		}
+		if batch.Seq != expected {
+			err := NewError(ErrorOutOfOrderBatch, "Unexpected batch %d, expected %d", batch.Seq, expected)
+			err.Seq, err.HasSeq = batch.Seq, true
+			return false, err
+		}
+		upload.lastSeq, upload.hasSeq = batch.Seq, true
+	}
+
+	s.bets = append(s.bets, batch.Bets...)
+	return true, nil
+}
+
+// complete Marks the upload of the agency as finished, performing the
+// raffle once every agency finished
+func (s *Server) complete(agency uint32, known bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if known {
+		upload := s.upload(agency)
+		if upload.completed {
+			return
+		}
+		upload.completed = true
+	}
+
+	s.processed++
+	if s.processed == s.options.Agencies {
+		s.raffle()
+	}
+}
+
+// raffle Picks the winners among the stored bets. Must be called with the
+// lock held
+func (s *Server) raffle() {
+	for _, bet := range s.bets {
+		agency, _ := strconv.ParseUint(bet.Agency, 10, 32)
+		if number, _ := strconv.Atoi(bet.Number); number == s.options.WinningNumber {
+			s.winners[uint32(agency)] = append(s.winners[uint32(agency)], bet.Document)
+		}
+	}
+	s.raffled = true
+}
+
+// results Counts a winners request of the agency, returning its number and
+// the winners if the raffle was performed
+func (s *Server) results(agency uint32) (int, []string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[agency]++
+	return s.requests[agency], append([]string(nil), s.winners[agency]...), s.raffled
+}
+
+// upload Returns the upload of the agency. Must be called with the lock held
+func (s *Server) upload(agency uint32) *upload {
+	if _, ok := s.uploads[agency]; !ok {
+		s.uploads[agency] = &upload{}
+	}
+	return s.uploads[agency]
+}
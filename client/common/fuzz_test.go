@@ -0,0 +1,233 @@
+//go:build go1.18
+// +build go1.18
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// replayConn A connection that reads the given bytes and then io.EOF,
+// discarding whatever is written to it
+type replayConn struct {
+	*bytes.Reader
+}
+
+func (c replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c replayConn) Close() error                       { return nil }
+func (c replayConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c replayConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayProtocol Returns a protocol with the given features that receives
+// data from the server
+func replayProtocol(data []byte, features uint32) *Protocol {
+	return &Protocol{
+		socket:       &Socket{conn: replayConn{bytes.NewReader(data)}},
+		GetBetSize:   serializedBetSize,
+		maxFrameSize: 8192,
+		version:      _PROTOCOL_VERSION,
+		features:     features & _CLIENT_FEATURES,
+		options:      ProtocolOptions{Compression: true},
+	}
+}
+
+// frame Returns the payload in a frame, as the server sends the winners
+func frame(code byte, payload []byte) []byte {
+	buf := []byte{code, _FRAME_VERSION}
+	buf = append(buf, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func FuzzReceiveResults(f *testing.F) {
+	compressed, _ := newCompressor().encode([]byte(strings.Repeat("30904465$", 50) + "1"))
+	f.Add([]byte{_RESULTS_NOT_READY}, uint32(0))
+	f.Add(frame(_SENDING_RESULTS, []byte("30904465$1")), uint32(0))
+	f.Add(frame(_SENDING_RESULTS, nil), uint32(_FEATURE_CHECKSUMS))
+	f.Add(frame(_SENDING_RESULTS, appendChecksum([]byte("30904465"))), uint32(_FEATURE_CHECKSUMS))
+	f.Add(frame(_SENDING_RESULTS, appendChecksum(compressed)), uint32(_FEATURE_CHECKSUMS|_FEATURE_COMPRESSION))
+	f.Add([]byte{_SENDING_RESULTS, _FRAME_VERSION, 0x00, 0xff, 0xff, 0xff}, uint32(0))
+	f.Add([]byte{_ERROR_CODE, byte(ErrorUnknown), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x01, 'x'}, uint32(_FEATURE_STRUCTURED_ERRORS))
+
+	f.Fuzz(func(t *testing.T, data []byte, features uint32) {
+		winners, err := replayProtocol(data, features).receiveResults(context.Background())
+		if err != nil {
+			if winners != nil {
+				t.Fatalf("expected no winners along error %v, got %q", err, winners)
+			}
+			return
+		}
+
+		for _, winner := range winners {
+			if !utf8.ValidString(winner) || strings.Contains(winner, _WINNER_SEPARATOR) {
+				t.Fatalf("invalid winner %q accepted", winner)
+			}
+		}
+	})
+}
+
+func FuzzReceiveAck(f *testing.F) {
+	f.Add([]byte{_BATCH_RECEIVED, 0, 0, 0, 7}, uint32(_FEATURE_PIPELINING))
+	f.Add([]byte{_BATCH_ALREADY_STORED, 0, 0, 0, 7}, uint32(_FEATURE_IDEMPOTENT_BATCHES))
+	f.Add([]byte{_BATCH_RECEIVED}, uint32(0))
+	f.Add([]byte{_BATCH_CORRUPTED}, uint32(_FEATURE_CHECKSUMS))
+	f.Add([]byte{_ERROR_CODE, byte(ErrorInvalidBet), 0, 0, 0, 2, 0, 0, 0, 1, 0, 3, 'b', 'a', 'd'}, uint32(_FEATURE_STRUCTURED_ERRORS))
+
+	f.Fuzz(func(t *testing.T, data []byte, features uint32) {
+		proto := replayProtocol(data, features)
+		ack, err := proto.receiveAck(context.Background())
+		if err == nil && !proto.sequenced() && ack.Seq != 0 {
+			t.Fatalf("expected the first unsequenced ack to be batch 0, got %d", ack.Seq)
+		}
+	})
+}
+
+func FuzzReceiveError(f *testing.F) {
+	f.Add([]byte{byte(ErrorInvalidBet), 0, 0, 0, 2, 0, 0, 0, 1, 0, 3, 'b', 'a', 'd'})
+	f.Add([]byte{byte(ErrorMalformedMessage), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0})
+	f.Add([]byte{0xff, 0, 0, 0, 0, 0x80, 0, 0, 0, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		err := replayProtocol(data, _FEATURE_STRUCTURED_ERRORS).receiveError(context.Background())
+
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) {
+			if serverErr.BetIndex < -1 {
+				t.Fatalf("invalid bet index %d", serverErr.BetIndex)
+			}
+			// The message of an unknown code must still be printable
+			_ = serverErr.Error()
+		}
+	})
+}
+
+func FuzzReceiveHandshakeReply(f *testing.F) {
+	f.Add([]byte{_HELLO_ACK, _PROTOCOL_VERSION, 0, 0, 0, 0xdd})
+	f.Add([]byte{_HELLO_ACK, _LEGACY_PROTOCOL_VERSION, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{_HELLO_ACK, 0xff, 0, 0, 0, 0})
+	f.Add([]byte{_ERROR_CODE})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		proto := replayProtocol(data, 0)
+		proto.features = 0
+		if _, err := proto.receiveHandshakeReply(context.Background()); err != nil {
+			return
+		}
+		if proto.features&^proto.advertisedFeatures() != 0 {
+			t.Fatalf("negotiated features %b the client did not advertise", proto.features)
+		}
+		if proto.version < _LEGACY_PROTOCOL_VERSION || proto.version > _PROTOCOL_VERSION {
+			t.Fatalf("negotiated unsupported version %d", proto.version)
+		}
+	})
+}
+
+func FuzzDecodePayload(f *testing.F) {
+	compressed, _ := newCompressor().encode([]byte(strings.Repeat("a", 1000)))
+	f.Add(compressed, uint32(1000))
+	f.Add(compressed, uint32(999))
+	f.Add([]byte{_CODEC_NONE, 'a'}, uint32(1))
+	f.Add([]byte{_CODEC_GZIP}, uint32(10))
+	f.Add([]byte{0xff}, uint32(10))
+
+	f.Fuzz(func(t *testing.T, payload []byte, maxSize uint32) {
+		maxSize %= 1 << 20
+		decoded, err := decodePayload(payload, maxSize)
+		if err == nil && payload[0] == _CODEC_GZIP && uint64(len(decoded)) > uint64(maxSize) {
+			t.Fatalf("decoded %d bytes, more than the %d allowed", len(decoded), maxSize)
+		}
+	})
+}
+
+func FuzzChecksum(f *testing.F) {
+	f.Add([]byte("30904465$1"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		data, err := verifyChecksum(appendChecksum(append([]byte(nil), payload...)))
+		if err != nil || !bytes.Equal(data, payload) {
+			t.Fatalf("checksum round trip of %x failed: %x, %v", payload, data, err)
+		}
+
+		if data, err := verifyChecksum(payload); err == nil && !bytes.Equal(appendChecksum(append([]byte(nil), data...)), payload) {
+			t.Fatalf("accepted %x with a wrong checksum", payload)
+		}
+	})
+}
+
+// decodeSerializedBet Decodes a bet as the server does
+func decodeSerializedBet(data []byte) ([]string, bool) {
+	fields := make([]string, 0, _FIELDS_PER_BET)
+	for i := 0; i < _FIELDS_PER_BET; i++ {
+		if len(data) < _FIELD_LENGTH_SIZE {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint16(data))
+		data = data[_FIELD_LENGTH_SIZE:]
+		if len(data) < length {
+			return nil, false
+		}
+		fields = append(fields, string(data[:length]))
+		data = data[length:]
+	}
+	return fields, len(data) == 0
+}
+
+func FuzzCreateBetFromCSVLine(f *testing.F) {
+	f.Add("Santiago Lionel,Lorca,30904465,1999-03-17,7574")
+	f.Add("\"Lorca, Santiago\",\"Juan \"\"Pepe\"\"\",1,2000-01-01,1")
+	f.Add("\"a\nb\",c,d,e,f")
+	f.Add(" a,\tb,c,d,\\.")
+	f.Add("a,b,c,d")
+	f.Add("\"a\rb\",c,d,e,f\r\n")
+
+	proto := replayProtocol(nil, 0)
+	f.Fuzz(func(t *testing.T, line string) {
+		bet := CreateBetFromCSVLine("1", line)
+		if bet == nil {
+			return
+		}
+
+		fields := []string{bet.agency, bet.firstName, bet.lastName, bet.document, bet.birthday, bet.number}
+		serialized, err := proto.serializeBet(bet)
+		if err != nil {
+			for _, field := range fields {
+				if len(field) > 0xffff {
+					return
+				}
+			}
+			t.Fatalf("could not serialize %+v: %v", *bet, err)
+		}
+
+		if len(serialized) != proto.GetBetSize(bet) {
+			t.Fatalf("bet takes %d bytes but its size is %d", len(serialized), proto.GetBetSize(bet))
+		}
+		decoded, ok := decodeSerializedBet(serialized)
+		if !ok {
+			t.Fatalf("could not decode serialized %+v", *bet)
+		}
+		for i := range fields {
+			if decoded[i] != fields[i] {
+				t.Fatalf("field %d serialized as %q instead of %q", i, decoded[i], fields[i])
+			}
+		}
+
+		// The raw text of a rejected bet must parse back to the same bet
+		again := CreateBetFromCSVLine("1", rawBet(bet))
+		if again == nil || *again != *bet {
+			t.Fatalf("bet %+v written as %q parsed back as %+v", *bet, rawBet(bet), again)
+		}
+	})
+}
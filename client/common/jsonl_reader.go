@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// jsonField A field of a bet in JSON Lines, which may be a string or a
+// number
+type jsonField struct {
+	value string
+	set   bool
+}
+
+func (f *jsonField) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		f.set = true
+		return json.Unmarshal(data, &f.value)
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil || number == "" {
+		return fmt.Errorf("expected a string or a number, got %s", data)
+	}
+	f.value, f.set = number.String(), true
+	return nil
+}
+
+// jsonBet The fields of a bet in JSON Lines. Other fields are ignored
+type jsonBet struct {
+	FirstName jsonField `json:"first_name"`
+	LastName  jsonField `json:"last_name"`
+	Document  jsonField `json:"document"`
+	Birthdate jsonField `json:"birthdate"`
+	Number    jsonField `json:"number"`
+}
+
+// JSONLBetReader Reads the bets of an agency from JSON Lines: one object per
+// line with the fields first_name, last_name, document, birthdate and number.
+// Blank lines are ignored
+type JSONLBetReader struct {
+	agency string
+	reader *bufio.Reader
+	line   int
+	raw    string
+}
+
+// NewJSONLBetReader Creates a reader of the bets of the agency in r. A
+// leading UTF-8 BOM is ignored
+func NewJSONLBetReader(agency string, r io.Reader) *JSONLBetReader {
+	reader := bufio.NewReader(r)
+	if prefix, _ := reader.Peek(len(_UTF8_BOM)); bytes.Equal(prefix, _UTF8_BOM) {
+		reader.Discard(len(_UTF8_BOM))
+	}
+	return &JSONLBetReader{agency: agency, reader: reader}
+}
+
+// Next Returns the bet in the next line that is not blank, or io.EOF once
+// there are no more. A line that is not a valid bet is returned as a
+// *RejectedRow error
+func (r *JSONLBetReader) Next() (*Bet, error) {
+	for {
+		text, err := r.reader.ReadString('\n')
+		if err == io.EOF && text == "" {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		r.line++
+		r.raw = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		if strings.TrimSpace(r.raw) == "" {
+			continue
+		}
+
+		var fields jsonBet
+		if err := json.Unmarshal([]byte(r.raw), &fields); err != nil {
+			return nil, &RejectedRow{Line: r.line, Raw: r.raw, Reason: fmt.Errorf("invalid JSON: %w", err)}
+		}
+
+		values := []struct {
+			name  string
+			field jsonField
+		}{
+			{"first_name", fields.FirstName},
+			{"last_name", fields.LastName},
+			{"document", fields.Document},
+			{"birthdate", fields.Birthdate},
+			{"number", fields.Number},
+		}
+		bet := make([]string, 0, len(values))
+		for _, value := range values {
+			if !value.field.set {
+				return nil, &RejectedRow{Line: r.line, Raw: r.raw, Reason: fmt.Errorf("missing field %v", value.name)}
+			}
+			bet = append(bet, value.field.value)
+		}
+
+		parsed := newBet(r.agency, bet)
+		parsed.line = r.line
+		return parsed, nil
+	}
+}
+
+// Raw Returns the last line read, without its line terminator
+func (r *JSONLBetReader) Raw() string {
+	return r.raw
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestJSONLBetReader(t *testing.T) {
+	jsonl := "\xEF\xBB\xBF" +
+		`{"first_name":"Santiago, Lionel","last_name":"Lorca","document":30904465,"birthdate":"1999-03-17","number":"7574","extra":true}` + "\r\n" +
+		"\n" +
+		`{"first_name":"Ana","last_name":"Diaz","document":"2","birthdate":"2001-02-03"}` + "\n" +
+		`{"first_name":"Juan",` + "\n" +
+		`{"first_name":"Juan","last_name":null,"document":1,"birthdate":"2000-01-01","number":1}` + "\n" +
+		`{"first_name":"Juan","last_name":"Perez","document":1,"birthdate":"2000-01-01","number":1}`
+
+	reader := NewJSONLBetReader("1", strings.NewReader(jsonl))
+
+	bet, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Bet{agency: "1", firstName: "Santiago, Lionel", lastName: "Lorca", document: "30904465", birthday: "1999-03-17", number: "7574", line: 1}
+	if *bet != expected {
+		t.Fatalf("expected bet %+v, got %+v", expected, *bet)
+	}
+
+	for _, line := range []int{3, 4, 5} {
+		var rejected *RejectedRow
+		if _, err := reader.Next(); !errors.As(err, &rejected) || rejected.Line != line || rejected.Raw != reader.Raw() {
+			t.Fatalf("expected line %d to be rejected, got %v", line, err)
+		}
+	}
+
+	bet, err = reader.Next()
+	if err != nil || bet.line != 6 || bet.lastName != "Perez" {
+		t.Fatalf("expected the bet at line 6, got %+v and %v", bet, err)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestMemoryBetSourceInBatches(t *testing.T) {
+	bets := []*Bet{
+		NewBet("1", "a", "b", "1", "2000-01-01", "1"),
+		NewBet("1", "c", "d", "x", "2000-01-01", "2"),
+		NewBet("1", "e", "f", "3", "2000-01-01", "3"),
+	}
+	validator, err := NewBetValidator("1", DefaultValidationRules(), ValidationSkip, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generator := NewBatchGenerator(NewMemoryBetSource(bets...), validator, 10, 1000, func(b *Bet) int { return 1 })
+	batch, err := generator.GetNextBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || batch[0].line != 1 || batch[1].line != 3 || batch[1].file != "memory" {
+		t.Fatalf("expected the bets at lines 1 and 3, got %+v", batch)
+	}
+	if generator.RecordsRead() != 3 || validator.Rejected() != 1 {
+		t.Fatalf("expected 3 records read and 1 rejected, got %d and %d", generator.RecordsRead(), validator.Rejected())
+	}
+	if bets[0].line != 0 {
+		t.Fatal("expected the source not to modify its bets")
+	}
+	if raw := rawBet(bets[1]); raw != "c,d,x,2000-01-01,2" {
+		t.Fatalf("unexpected raw bet %q", raw)
+	}
+}
@@ -0,0 +1,195 @@
+// Package loadgen runs many virtual agencies against a server from a single
+// process. Each agency uploads its bets and waits for its winners with a
+// client of its own, as the agency containers do, while the acknowledgements
+// of every batch are collected to report the throughput and latency of the
+// server.
+package loadgen
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+var log = logging.MustGetLogger("log")
+
+// AgencyPlaceholder is replaced by the id of each agency in Options.BetsFiles
+const AgencyPlaceholder = "{agency}"
+
+// Options Configuration of a load test
+type Options struct {
+	ServerAddress string
+	// TLS encrypts the connection of every agency if not nil
+	TLS *tls.Config
+	// Agencies is the amount of virtual agencies, with consecutive ids
+	// starting at FirstAgency
+	Agencies    int
+	FirstAgency int
+	// BetsFiles are the files with the bets of each agency, as accepted by
+	// common.NewBetsInput, where AgencyPlaceholder is replaced by its id.
+	// If empty, BetsPerAgency synthetic bets are generated from Seed
+	BetsFiles     string
+	BetsPerAgency int
+	Seed          int64
+	BatchAmount   int
+	BatchMaxSize  int
+	BatchWindow   int
+	// ThinkTime is waited by every agency between consecutive batches
+	ThinkTime   time.Duration
+	Compression bool
+	// ResumeMaxRetries is how many times each agency resumes its upload
+	// after losing the connection
+	ResumeMaxRetries int
+	Retry            common.RetryPolicy
+	Timeouts         common.Timeouts
+}
+
+// DefaultOptions Returns the options of a load test of five agencies
+// uploading a thousand synthetic bets each, configured as the agency
+// containers are
+func DefaultOptions() Options {
+	return Options{
+		ServerAddress:    "localhost:12345",
+		Agencies:         5,
+		FirstAgency:      1,
+		BetsPerAgency:    1000,
+		Seed:             1,
+		BatchAmount:      150,
+		BatchMaxSize:     8 * 1024,
+		BatchWindow:      8,
+		Compression:      true,
+		ResumeMaxRetries: 3,
+		Retry: common.RetryPolicy{
+			InitialDelay: 500 * time.Millisecond,
+			Multiplier:   2,
+			MaxDelay:     5 * time.Second,
+			Jitter:       0.2,
+			MaxAttempts:  10,
+		},
+		Timeouts: common.Timeouts{
+			Connect: 5 * time.Second,
+			Write:   10 * time.Second,
+			Ack:     30 * time.Second,
+			Results: 30 * time.Second,
+		},
+	}
+}
+
+// Validate Returns an error if the options cannot run a load test
+func (o Options) Validate() error {
+	switch {
+	case o.ServerAddress == "":
+		return errors.New("server address is required")
+	case o.Agencies < 1:
+		return fmt.Errorf("invalid amount of agencies %d, it must be at least 1", o.Agencies)
+	case o.FirstAgency < 0:
+		return fmt.Errorf("invalid first agency %d, it must not be negative", o.FirstAgency)
+	case o.BetsFiles == "" && o.BetsPerAgency < 1:
+		return fmt.Errorf("invalid amount of bets per agency %d, it must be at least 1", o.BetsPerAgency)
+	case o.BatchAmount < 1:
+		return fmt.Errorf("invalid batch amount %d, it must be at least 1", o.BatchAmount)
+	case o.BatchMaxSize < 1:
+		return fmt.Errorf("invalid batch max size %d, it must be at least 1 byte", o.BatchMaxSize)
+	case o.BatchWindow < 1:
+		return fmt.Errorf("invalid batch window %d, it must be at least 1", o.BatchWindow)
+	case o.ThinkTime < 0:
+		return fmt.Errorf("invalid think time %v, it must not be negative", o.ThinkTime)
+	}
+	return nil
+}
+
+// Run Starts every agency at once and waits for all of them to get their
+// winners or fail. Cancelling ctx stops the agencies, and the report covers
+// what they did until then. Fails only if the options are invalid
+func Run(ctx context.Context, options Options) (*Report, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	collector := newCollector(time.Now())
+	var wg sync.WaitGroup
+	for i := 0; i < options.Agencies; i++ {
+		agency := options.FirstAgency + i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := common.NewClient(options.clientConfig(agency, collector)).Start(ctx)
+			if err != nil {
+				log.Errorf("action: loadgen_agency | result: fail | client_id: %v | error: %v", agency, err)
+			}
+			collector.agencyDone(err)
+		}()
+	}
+	wg.Wait()
+
+	return collector.report(time.Now()), nil
+}
+
+// clientConfig Returns the configuration of the client of the agency, which
+// reports its acknowledgements to the collector
+func (o Options) clientConfig(agency int, collector *collector) common.ClientConfig {
+	config := common.ClientConfig{
+		ID:            fmt.Sprint(agency),
+		ServerAddress: o.ServerAddress,
+		TLS:           o.TLS,
+		// Invalid rows of the files are left out instead of stopping the
+		// agency
+		ValidationRules:     common.DefaultValidationRules(),
+		ValidationMode:      common.ValidationSkip,
+		MaxRejectRatio:      1,
+		BatchAmount:         o.BatchAmount,
+		BatchMaxSize:        o.BatchMaxSize,
+		BatchWindow:         o.BatchWindow,
+		ThinkTime:           o.ThinkTime,
+		ResumeMaxRetries:    o.ResumeMaxRetries,
+		Retry:               o.Retry,
+		Timeouts:            o.Timeouts,
+		Compression:         o.Compression,
+		ShutdownGracePeriod: o.Timeouts.Ack,
+		OnBatchAcked:        collector.batchAcked,
+	}
+
+	if o.BetsFiles != "" {
+		config.BetsFiles = strings.ReplaceAll(o.BetsFiles, AgencyPlaceholder, config.ID)
+		config.CSV = common.DefaultCSVOptions()
+		return config
+	}
+
+	bets := SyntheticBets(agency, o.BetsPerAgency, o.Seed)
+	config.OpenBets = func() (common.BetSource, error) {
+		return common.NewMemoryBetSource(bets...), nil
+	}
+	return config
+}
+
+var firstNames = []string{"Santiago Lionel", "María", "Juan", "Ana Laura", "José", "Lucía", "Martín", "Sofía"}
+var lastNames = []string{"Lorca", "González", "Rodríguez", "Fernández", "López", "Martínez", "Pérez", "Gómez"}
+
+// SyntheticBets Returns amount valid bets of the agency, which are always
+// the same for a given seed
+func SyntheticBets(agency int, amount int, seed int64) []*common.Bet {
+	rng := rand.New(rand.NewSource(seed + int64(agency)))
+	birthdates := time.Date(1940, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	bets := make([]*common.Bet, 0, amount)
+	for i := 0; i < amount; i++ {
+		bets = append(bets, common.NewBet(
+			fmt.Sprint(agency),
+			firstNames[rng.Intn(len(firstNames))],
+			lastNames[rng.Intn(len(lastNames))],
+			fmt.Sprint(10000000+rng.Intn(90000000)),
+			birthdates.AddDate(0, 0, rng.Intn(60*365)).Format("2006-01-02"),
+			fmt.Sprint(rng.Intn(10000)),
+		))
+	}
+	return bets
+}
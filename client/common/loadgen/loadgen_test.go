@@ -0,0 +1,122 @@
+package loadgen
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common/fakeserver"
+)
+
+// startServer Starts a fake server that is closed when the test finishes
+func startServer(t *testing.T, options fakeserver.Options) *fakeserver.Server {
+	t.Helper()
+
+	server, err := fakeserver.Start(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testOptions Returns the options of a load test of the agencies against
+// the server, uploading 50 bets each in batches of 10
+func testOptions(address string, agencies int) Options {
+	options := DefaultOptions()
+	options.ServerAddress = address
+	options.Agencies = agencies
+	options.BetsPerAgency = 50
+	options.BatchAmount = 10
+	options.BatchWindow = 2
+	options.Retry.InitialDelay = 10 * time.Millisecond
+	options.Retry.MaxDelay = 10 * time.Millisecond
+	options.Retry.MaxAttempts = 500
+	options.Timeouts.Ack = time.Second
+	options.Timeouts.Results = time.Second
+	return options
+}
+
+func TestRunReportsEveryAgency(t *testing.T) {
+	server := startServer(t, fakeserver.Options{Agencies: 4})
+
+	options := testOptions(server.Addr(), 4)
+	options.ThinkTime = 10 * time.Millisecond
+	report, err := Run(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Agencies != 4 || report.Succeeded != 4 || len(report.Errors) != 0 {
+		t.Fatalf("expected every agency to succeed, got %+v", report)
+	}
+	if report.Bets != 200 || report.Batches != 20 || len(server.Bets()) != 200 {
+		t.Fatalf("expected 200 bets in 20 batches, reported %d in %d and stored %d", report.Bets, report.Batches, len(server.Bets()))
+	}
+	if report.Latency.P50 <= 0 || report.Latency.P50 > report.Latency.Max {
+		t.Fatalf("unexpected ack latencies %+v", report.Latency)
+	}
+	if report.Upload < 4*options.ThinkTime || report.Elapsed < report.Upload {
+		t.Fatalf("expected the upload to be paced by the think time, took %v of %v", report.Upload, report.Elapsed)
+	}
+	if !server.Raffled() {
+		t.Fatal("expected the raffle to be performed")
+	}
+}
+
+func TestRunCountsErrorsByKind(t *testing.T) {
+	server := startServer(t, fakeserver.Options{
+		Agencies: 3,
+		Hooks: fakeserver.Hooks{
+			Batch: func(batch fakeserver.Batch) fakeserver.Fault {
+				if batch.Agency != 2 {
+					return fakeserver.Fault{}
+				}
+				return fakeserver.Fault{Error: fakeserver.NewError(fakeserver.ErrorInvalidBet, "rejected by test")}
+			},
+		},
+	})
+
+	report, err := Run(context.Background(), testOptions(server.Addr(), 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Succeeded != 3 || !reflect.DeepEqual(report.Errors, map[string]int{"server invalid_bet": 1}) {
+		t.Fatalf("expected agency 2 to fail with an invalid bet, got %+v", report)
+	}
+}
+
+func TestRunRejectsInvalidOptions(t *testing.T) {
+	options := testOptions("localhost:12345", 0)
+	if _, err := Run(context.Background(), options); err == nil {
+		t.Fatal("expected a load test without agencies to be rejected")
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	latencies := make([]time.Duration, 0, 100)
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	expected := Latencies{P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}
+	if got := percentiles(latencies); got != expected {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	single := Latencies{P50: time.Second, P90: time.Second, P99: time.Second, Max: time.Second}
+	if got := percentiles([]time.Duration{time.Second}); got != single {
+		t.Fatalf("expected %+v, got %+v", single, got)
+	}
+}
+
+func TestSyntheticBetsAreDeterministic(t *testing.T) {
+	if !reflect.DeepEqual(SyntheticBets(1, 20, 7), SyntheticBets(1, 20, 7)) {
+		t.Fatal("expected the same bets for the same seed")
+	}
+	if reflect.DeepEqual(SyntheticBets(1, 20, 7), SyntheticBets(2, 20, 7)) {
+		t.Fatal("expected different bets for different agencies")
+	}
+}
@@ -0,0 +1,207 @@
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// Latencies Percentiles of the time the server took to acknowledge a batch
+type Latencies struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Report The outcome of a load test
+type Report struct {
+	Agencies  int
+	Succeeded int
+	// Bets and Batches acknowledged by the server, including the
+	// AlreadyStored ones sent again after resuming an upload
+	Bets          int
+	Batches       int
+	AlreadyStored int
+	// Upload is the time from the start of the test to the last
+	// acknowledgement, and Elapsed the time until every agency finished
+	Upload  time.Duration
+	Elapsed time.Duration
+	Latency Latencies
+	// Errors is the amount of agencies that failed by each kind of error
+	Errors map[string]int
+}
+
+// BetsPerSecond Returns the bets acknowledged per second of upload
+func (r *Report) BetsPerSecond() float64 {
+	return perSecond(r.Bets, r.Upload)
+}
+
+// BatchesPerSecond Returns the batches acknowledged per second of upload
+func (r *Report) BatchesPerSecond() float64 {
+	return perSecond(r.Batches, r.Upload)
+}
+
+func perSecond(amount int, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(amount) / duration.Seconds()
+}
+
+// String Returns the report as human readable text
+func (r *Report) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "agencies:      %d (%d succeeded, %d failed)\n", r.Agencies, r.Succeeded, r.Agencies-r.Succeeded)
+	fmt.Fprintf(&buf, "bets:          %d in %d batches (%d batches already stored)\n", r.Bets, r.Batches, r.AlreadyStored)
+	fmt.Fprintf(&buf, "upload:        %v\n", r.Upload.Round(time.Millisecond))
+	fmt.Fprintf(&buf, "elapsed:       %v\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&buf, "throughput:    %.1f bets/s, %.1f batches/s\n", r.BetsPerSecond(), r.BatchesPerSecond())
+	fmt.Fprintf(&buf, "ack latency:   p50 %v | p90 %v | p99 %v | max %v\n",
+		r.Latency.P50.Round(time.Microsecond),
+		r.Latency.P90.Round(time.Microsecond),
+		r.Latency.P99.Round(time.Microsecond),
+		r.Latency.Max.Round(time.Microsecond),
+	)
+
+	kinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Fprintf(&buf, "errors:        %d\n", r.Agencies-r.Succeeded)
+	for _, kind := range kinds {
+		fmt.Fprintf(&buf, "  %-26v %d\n", kind+":", r.Errors[kind])
+	}
+	return buf.String()
+}
+
+// collector Gathers the acknowledgements and outcomes of every agency
+type collector struct {
+	mu            sync.Mutex
+	start         time.Time
+	lastAck       time.Time
+	latencies     []time.Duration
+	bets          int
+	alreadyStored int
+	agencies      int
+	succeeded     int
+	errors        map[string]int
+}
+
+func newCollector(start time.Time) *collector {
+	return &collector{
+		start:   start,
+		lastAck: start,
+		errors:  make(map[string]int),
+	}
+}
+
+// batchAcked Records an acknowledgement, as reported by the client of an
+// agency
+func (c *collector) batchAcked(ack common.BatchAck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastAck = time.Now()
+	c.latencies = append(c.latencies, ack.Latency)
+	c.bets += ack.Bets
+	if ack.AlreadyStored {
+		c.alreadyStored++
+	}
+}
+
+// agencyDone Records how an agency finished
+func (c *collector) agencyDone(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.agencies++
+	if err == nil {
+		c.succeeded++
+		return
+	}
+	c.errors[errorKind(err)]++
+}
+
+// report Returns what was collected until end
+func (c *collector) report(end time.Time) *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	errorKinds := make(map[string]int, len(c.errors))
+	for kind, amount := range c.errors {
+		errorKinds[kind] = amount
+	}
+
+	return &Report{
+		Agencies:      c.agencies,
+		Succeeded:     c.succeeded,
+		Bets:          c.bets,
+		Batches:       len(c.latencies),
+		AlreadyStored: c.alreadyStored,
+		Upload:        c.lastAck.Sub(c.start),
+		Elapsed:       end.Sub(c.start),
+		Latency:       percentiles(c.latencies),
+		Errors:        errorKinds,
+	}
+}
+
+// percentiles Returns the percentiles of the latencies by the nearest rank
+// method, sorting them
+func percentiles(latencies []time.Duration) Latencies {
+	if len(latencies) == 0 {
+		return Latencies{}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rank := func(percentile int) time.Duration {
+		index := (percentile*len(latencies)+99)/100 - 1
+		if index < 0 {
+			index = 0
+		}
+		return latencies[index]
+	}
+	return Latencies{
+		P50: rank(50),
+		P90: rank(90),
+		P99: rank(99),
+		Max: latencies[len(latencies)-1],
+	}
+}
+
+// errorKind Returns the kind of error an agency failed with, as counted in
+// the report
+func errorKind(err error) string {
+	var timeoutErr *common.TimeoutError
+	var serverErr *common.ServerError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	case errors.As(err, &timeoutErr):
+		return "timeout " + timeoutErr.Op
+	case errors.As(err, &serverErr):
+		return "server " + serverErr.Code.String()
+	case errors.Is(err, common.ErrAuthenticationFailed):
+		return "authentication failed"
+	case errors.Is(err, common.ErrUnsupportedServerVersion):
+		return "unsupported server version"
+	case errors.Is(err, common.ErrChecksumMismatch):
+		return "checksum mismatch"
+	case errors.Is(err, common.ErrTooManyRejects):
+		return "too many rejects"
+	case errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection"
+	default:
+		return "other"
+	}
+}
@@ -1,16 +1,41 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-const _BET_SEPARATOR = "|"
-const _BATCH_SEPARATOR = "#"
 const _WINNER_SEPARATOR = "$"
-// entre cada campo va un "|" y un "#" al final
-const _SEPARATORS_PER_BET = 6
+// each bet field is sent as a uint16 length followed by its utf-8 bytes
+const _FIELDS_PER_BET = 6
+const _FIELD_LENGTH_SIZE = 2
+
+// every batch and winners payload travels in a frame made of a version byte
+// and a uint32 length, followed by the payload itself
+const _FRAME_VERSION = 1
+const _FRAME_HEADER_SIZE = 5
+// upper bound for the winners frame, to avoid allocating whatever length
+// a misbehaving server announces
+const _MAX_RESULTS_FRAME_SIZE = 16 * 1024 * 1024
+// when pipelining, every batch frame starts with its uint32 sequence number
+// and every acknowledgement carries the sequence number it refers to
+const _SEQUENCE_NUMBER_SIZE = 4
+// with idempotent batches, every batch frame starts with its id, made of the
+// uint32 agency id followed by the uint32 sequence number
+const _BATCH_ID_SIZE = 4 + _SEQUENCE_NUMBER_SIZE
+
+// status of the agency upload, as answered by the server when resuming it
+const _UPLOAD_NOT_STARTED = 0
+const _UPLOAD_IN_PROGRESS = 1
+const _UPLOAD_COMPLETED = 2
 
 const _SENDING_BETS = 0
 const _BATCH_RECEIVED = 1
@@ -18,53 +43,428 @@ const _REQUEST_RESULTS = 2
 const _RESULTS_NOT_READY = 3
 const _SENDING_RESULTS = 4
 const _ERROR_CODE = 5
+const _HELLO = 6
+const _HELLO_ACK = 7
+const _BATCH_ALREADY_STORED = 8
+const _AUTH = 9
+const _AUTH_CHALLENGE = 10
+const _AUTH_OK = 11
+const _BATCH_CORRUPTED = 12
+
+// _PROTOCOL_VERSION is the version advertised in the handshake. Version 1 is
+// the legacy protocol, spoken without any handshake
+const _PROTOCOL_VERSION = 2
+const _LEGACY_PROTOCOL_VERSION = 1
+
+// Feature flags advertised in the handshake. Only the ones supported by both
+// sides are used in the connection
+const _FEATURE_WIDE_IDS = 1 << 0
+const _FEATURE_COMPRESSION = 1 << 1
+const _FEATURE_RESUMABLE_UPLOAD = 1 << 2
+const _FEATURE_PIPELINING = 1 << 3
+const _FEATURE_IDEMPOTENT_BATCHES = 1 << 4
+const _FEATURE_AUTHENTICATION = 1 << 5
+const _FEATURE_CHECKSUMS = 1 << 6
+const _FEATURE_STRUCTURED_ERRORS = 1 << 7
+
+const _CLIENT_FEATURES = _FEATURE_WIDE_IDS | _FEATURE_COMPRESSION | _FEATURE_PIPELINING |
+	_FEATURE_RESUMABLE_UPLOAD | _FEATURE_IDEMPOTENT_BATCHES | _FEATURE_AUTHENTICATION |
+	_FEATURE_CHECKSUMS | _FEATURE_STRUCTURED_ERRORS
+// features of a legacy server, either one that does not know the handshake
+// or one answering it with the legacy version. Both receive the agency id as
+// an uint32
+const _LEGACY_FEATURES = _FEATURE_WIDE_IDS
+
+var ErrUnsupportedServerVersion = errors.New("unsupported server version")
+
+// ProtocolOptions How the connection with the server is established
+type ProtocolOptions struct {
+	// TLS encrypts the connection if not nil
+	TLS      *tls.Config
+	Timeouts Timeouts
+	// Compression advertises compressed frames to the server
+	Compression bool
+}
+
+// Timeouts Maximum time each operation with the server may take before
+// failing with a TimeoutError. A zero value means no timeout
+type Timeouts struct {
+	// Connect bounds establishing the connection
+	Connect time.Duration
+	// Write bounds sending each message
+	Write time.Duration
+	// Ack bounds waiting for the acknowledgement of a batch, and for the
+	// replies of the handshake and the start of the upload
+	Ack time.Duration
+	// Results bounds waiting for the answer to a winners request
+	Results time.Duration
+}
+
+// UploadStatus What the server already stored from the bets of an agency
+type UploadStatus struct {
+	// Completed is true if the server already received every bet of the agency
+	Completed bool
+	// HasCommitted is true if the server stored at least one batch, being
+	// LastCommittedSeq the sequence number of the last one
+	HasCommitted     bool
+	LastCommittedSeq uint32
+}
+
+// Ack The acknowledgement of a batch sent to the server
+type Ack struct {
+	Seq uint32
+	// AlreadyStored is true if the batch is a retransmission of one the
+	// server had already stored, so it was not stored again
+	AlreadyStored bool
+}
 
 type Protocol struct {
 	socket *Socket
 	GetBetSize func(b *Bet) int
+	maxFrameSize uint32
+	version uint8
+	features uint32
+	options ProtocolOptions
+	agencyId uint32
+	// reused to compress every frame
+	compressor *compressor
+	// sequence numbers of the next batch to be sent and acknowledged.
+	// Each of them is only accessed by the goroutine sending batches
+	// and the one waiting confirmations, respectively
+	nextSeq uint32
+	nextAckSeq uint32
 }
 
-func NewProtocol(serverAddress string) (*Protocol, error) {
-	socket, err := Connect(serverAddress)
+// NewProtocol Connects to the server and performs the handshake. If the server
+// closes the connection without answering the handshake, it reconnects and
+// falls back to the legacy protocol. If the server answers with a version the
+// client cannot speak, an error wrapping ErrUnsupportedServerVersion is
+// returned
+func NewProtocol(ctx context.Context, serverAddress string, options ProtocolOptions) (*Protocol, error) {
+	proto, err := newProtocol(ctx, serverAddress, options)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, err := proto.handshake(ctx)
 	if err != nil {
+		proto.Close()
 		return nil, err
 	}
 
-	betSize := func(b *Bet) int {
-		return len(b.agency) +
-			len(b.firstName) + 
-			len(b.lastName) + 
-			len(b.document) + 
-			len(b.birthday) + 
-			len(b.number) + _SEPARATORS_PER_BET
+	if legacy {
+		proto.Close()
+		proto, err = newProtocol(ctx, serverAddress, options)
+		if err != nil {
+			return nil, err
+		}
+		proto.version = _LEGACY_PROTOCOL_VERSION
+		proto.features = _LEGACY_FEATURES
+	}
+
+	return proto, nil
+}
+
+func newProtocol(ctx context.Context, serverAddress string, options ProtocolOptions) (*Protocol, error) {
+	socket, err := Connect(ctx, serverAddress, options.TLS, options.Timeouts.Connect, options.Timeouts.Write)
+	if err != nil {
+		return nil, err
 	}
-	return &Protocol{socket: socket, GetBetSize: betSize}, nil
+
+	return &Protocol{socket: socket, GetBetSize: serializedBetSize, options: options}, nil
 }
 
+// serializedBetSize Returns the bytes the bet takes in a batch
+func serializedBetSize(b *Bet) int {
+	return len(b.agency) +
+		len(b.firstName) +
+		len(b.lastName) +
+		len(b.document) +
+		len(b.birthday) +
+		len(b.number) + _FIELDS_PER_BET*_FIELD_LENGTH_SIZE
+}
+
+// Close Closes the connection. It is safe to call it more than once
 func (proto *Protocol) Close() error {
 	return proto.socket.Close()
 }
 
-func (proto *Protocol) serializeBet(bet *Bet) string {
-	serialized := strings.Join([]string{
+// Version Returns the protocol version negotiated with the server
+func (proto *Protocol) Version() uint8 {
+	return proto.version
+}
+
+// Features Returns the feature flags negotiated with the server
+func (proto *Protocol) Features() uint32 {
+	return proto.features
+}
+
+func (proto *Protocol) supports(feature uint32) bool {
+	return proto.features&feature != 0
+}
+
+// Pipelined Returns true if the server accepts several batches in flight,
+// acknowledging each of them by its sequence number
+func (proto *Protocol) Pipelined() bool {
+	return proto.supports(_FEATURE_PIPELINING)
+}
+
+// Resumable Returns true if the server keeps track of the batches stored
+// from each agency, so an interrupted upload can be resumed
+func (proto *Protocol) Resumable() bool {
+	return proto.supports(_FEATURE_RESUMABLE_UPLOAD)
+}
+
+// Idempotent Returns true if every batch carries a stable id, so the server
+// does not store again a batch that is sent more than once
+func (proto *Protocol) Idempotent() bool {
+	return proto.supports(_FEATURE_IDEMPOTENT_BATCHES)
+}
+
+// Compressed Returns true if every non empty frame starts with the codec its
+// payload is encoded with
+func (proto *Protocol) Compressed() bool {
+	return proto.supports(_FEATURE_COMPRESSION)
+}
+
+// Checksummed Returns true if every non empty frame ends with a checksum
+func (proto *Protocol) Checksummed() bool {
+	return proto.supports(_FEATURE_CHECKSUMS)
+}
+
+// RequiresAuthentication Returns true if the server requires the agency to
+// Authenticate before any other action
+func (proto *Protocol) RequiresAuthentication() bool {
+	return proto.supports(_FEATURE_AUTHENTICATION)
+}
+
+// sequenced Returns true if batches and acknowledgements carry sequence numbers
+func (proto *Protocol) sequenced() bool {
+	return proto.Pipelined() || proto.Resumable() || proto.Idempotent()
+}
+
+// batchHeaderSize Returns the size of the metadata sent along the bets in
+// every batch frame
+func (proto *Protocol) batchHeaderSize() int {
+	size := 0
+	if proto.Checksummed() {
+		size += _CHECKSUM_SIZE
+	}
+	if proto.Compressed() {
+		size += _CODEC_SIZE
+	}
+	if proto.Idempotent() {
+		return size + _BATCH_ID_SIZE
+	}
+	if proto.sequenced() {
+		return size + _SEQUENCE_NUMBER_SIZE
+	}
+	return size
+}
+
+// MaxBatchSize Returns the maximum size of the serialized bets of a batch,
+// which is the negotiated frame size minus the batch metadata. The size is
+// measured before compression, so a batch always fits in a frame even if
+// it does not compress
+func (proto *Protocol) MaxBatchSize() int {
+	return int(proto.maxFrameSize) - proto.batchHeaderSize()
+}
+
+// handshake Advertises the protocol version and features supported by the
+// client, and stores the ones chosen by the server. Returns true if the
+// server closed the connection cleanly before answering, meaning it only
+// speaks the legacy protocol
+func (proto *Protocol) handshake(ctx context.Context) (bool, error) {
+	buf := []byte{_HELLO, _PROTOCOL_VERSION}
+	buf = append(buf, proto.uint32ToBytes(proto.advertisedFeatures())...)
+	if err := proto.socket.SendAll(ctx, buf); err != nil {
+		return false, err
+	}
+
+	legacy := false
+	err := proto.receiveWithin("handshake", proto.options.Timeouts.Ack, func() error {
+		var err error
+		legacy, err = proto.receiveHandshakeReply(ctx)
+		return err
+	})
+	return legacy, err
+}
+
+func (proto *Protocol) receiveHandshakeReply(ctx context.Context) (bool, error) {
+	action, err := proto.receiveAction(ctx)
+	if err == io.EOF {
+		// Servers that do not know the handshake close the connection
+		// without answering. Any other error, such as a reset or a
+		// timeout, is not taken as a legacy server
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch action {
+		case _HELLO_ACK:
+		case _ERROR_CODE:
+			return false, fmt.Errorf("%w: server rejected protocol version %d", ErrUnsupportedServerVersion, _PROTOCOL_VERSION)
+		default:
+			return false, fmt.Errorf("unexpected code received from server: %d", action)
+	}
+
+	reply, err := proto.socket.ReceiveAll(ctx, 5)
+	if err != nil {
+		return false, err
+	}
+
+	version := reply[0]
+	if version < _LEGACY_PROTOCOL_VERSION || version > _PROTOCOL_VERSION {
+		return false, fmt.Errorf("%w: %d", ErrUnsupportedServerVersion, version)
+	}
+
+	proto.version = version
+	proto.features = binary.BigEndian.Uint32(reply[1:]) & proto.advertisedFeatures()
+	if version == _LEGACY_PROTOCOL_VERSION {
+		proto.features = _LEGACY_FEATURES
+	}
+	return false, nil
+}
+
+// Authenticate Proves to the server that the client speaks for the agency,
+// answering a random challenge with an HMAC keyed by the agency secret.
+// Returns an error wrapping ErrAuthenticationFailed if the server rejects it
+func (proto *Protocol) Authenticate(ctx context.Context, agencyId uint32, secret []byte) error {
+	buf := []byte{_AUTH}
+	buf = append(buf, proto.uint32ToBytes(agencyId)...)
+	if err := proto.socket.SendAll(ctx, buf); err != nil {
+		return err
+	}
+
+	var nonce []byte
+	err := proto.receiveWithin("auth", proto.options.Timeouts.Ack, func() error {
+		if err := proto.receiveAuthReply(ctx, _AUTH_CHALLENGE, agencyId); err != nil {
+			return err
+		}
+
+		var err error
+		nonce, err = proto.socket.ReceiveAll(ctx, _AUTH_NONCE_SIZE)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := proto.socket.SendAll(ctx, authResponse(secret, nonce, agencyId)); err != nil {
+		return err
+	}
+
+	return proto.receiveWithin("auth", proto.options.Timeouts.Ack, func() error {
+		return proto.receiveAuthReply(ctx, _AUTH_OK, agencyId)
+	})
+}
+
+// receiveAuthReply Receives the next code of the authentication, failing if
+// it is not the expected one
+func (proto *Protocol) receiveAuthReply(ctx context.Context, expected int, agencyId uint32) error {
+	action, err := proto.receiveAction(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+		case expected:
+			return nil
+		case _ERROR_CODE:
+			return fmt.Errorf("%w: server rejected agency %d: %v", ErrAuthenticationFailed, agencyId, proto.receiveError(ctx))
+		default:
+			return fmt.Errorf("unexpected code received from server: %d", action)
+	}
+}
+
+// advertisedFeatures Returns the features the client offers in the handshake
+func (proto *Protocol) advertisedFeatures() uint32 {
+	features := uint32(_CLIENT_FEATURES)
+	if !proto.options.Compression {
+		features &^= _FEATURE_COMPRESSION
+	}
+	return features
+}
+
+// serializeBet Encodes every field of the bet as a length-prefixed string, so
+// no character inside a field can be mistaken for a delimiter
+func (proto *Protocol) serializeBet(bet *Bet) ([]byte, error) {
+	fields := []string{
 		bet.agency, bet.firstName, bet.lastName, bet.document, bet.birthday, bet.number,
-	}, _BET_SEPARATOR)
-	return serialized
+	}
+
+	buf := make([]byte, 0, proto.GetBetSize(bet))
+	for _, field := range fields {
+		if len(field) > math.MaxUint16 {
+			return nil, fmt.Errorf("bet field too long: %d bytes", len(field))
+		}
+		buf = append(buf, proto.uint16ToBytes(uint16(len(field)))...)
+		buf = append(buf, field...)
+	}
+	return buf, nil
 }
 
-func (proto *Protocol) StartSendingBets() error {
+// StartSendingBets Informs the server that the bets of the agency are about to
+// be sent, along with the maximum frame size the client would like to use. The
+// server answers with the maximum size it accepts, which is never greater than
+// the requested one. Batches must then be sized according to MaxBatchSize
+func (proto *Protocol) StartSendingBets(ctx context.Context, agencyId uint32, maxFrameSize uint32) error {
+	proto.agencyId = agencyId
+
 	buf := []byte{_SENDING_BETS}
-	return proto.socket.SendAll(buf)
+	buf = append(buf, proto.uint32ToBytes(maxFrameSize)...)
+	if err := proto.socket.SendAll(ctx, buf); err != nil {
+		return err
+	}
+
+	var negotiated uint32
+	err := proto.receiveWithin("ack-wait", proto.options.Timeouts.Ack, func() error {
+		var err error
+		negotiated, err = proto.receiveUint32(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if negotiated == 0 || negotiated > maxFrameSize {
+		return fmt.Errorf("invalid max frame size received from server: %d", negotiated)
+	}
+
+	proto.maxFrameSize = negotiated
+	return nil
 }
 
-func (proto *Protocol) RequestResults(agencyId int) ([]string, error) {
-	buf := []byte{_REQUEST_RESULTS, byte(agencyId)}
-	err := proto.socket.SendAll(buf)
+// RequestResults Asks the server for the winners of the agency. Returns nil
+// winners if the raffle was not performed yet
+func (proto *Protocol) RequestResults(ctx context.Context, agencyId uint32) ([]string, error) {
+	buf := []byte{_REQUEST_RESULTS}
+	if proto.supports(_FEATURE_WIDE_IDS) {
+		buf = append(buf, proto.uint32ToBytes(agencyId)...)
+	} else if agencyId <= math.MaxUint8 {
+		buf = append(buf, byte(agencyId))
+	} else {
+		return nil, fmt.Errorf("agency id %d does not fit in a byte and the server does not support wide ids", agencyId)
+	}
+
+	err := proto.socket.SendAll(ctx, buf)
 	if err != nil {
 		return nil, err
 	}
 
-	action, err := proto.receiveAction()
+	var winners []string
+	err = proto.receiveWithin("results-wait", proto.options.Timeouts.Results, func() error {
+		var err error
+		winners, err = proto.receiveResults(ctx)
+		return err
+	})
+	return winners, err
+}
+
+func (proto *Protocol) receiveResults(ctx context.Context) ([]string, error) {
+	action, err := proto.receiveAction(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -73,65 +473,233 @@ func (proto *Protocol) RequestResults(agencyId int) ([]string, error) {
 		case _RESULTS_NOT_READY:
 			return nil, nil
 		case _SENDING_RESULTS:
-			return proto.receiveWinners()
+			return proto.receiveWinners(ctx)
+		case _ERROR_CODE:
+			return nil, proto.receiveError(ctx)
 		default:
 			return nil, fmt.Errorf("unexpected code received from server: %d", action)
 	}
 }
 
-func (proto *Protocol) receiveWinners() ([]string, error) {
-	winnersLen, err := proto.receiveUint16()
+func (proto *Protocol) receiveWinners(ctx context.Context) ([]string, error) {
+	serializedWinners, err := proto.receiveFrame(ctx, _MAX_RESULTS_FRAME_SIZE)
 	if err != nil {
 		return nil, err
 	}
 
-	if winnersLen == 0 {
+	if proto.Checksummed() && len(serializedWinners) > 0 {
+		serializedWinners, err = verifyChecksum(serializedWinners)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if proto.Compressed() && len(serializedWinners) > 0 {
+		serializedWinners, err = decodePayload(serializedWinners, _MAX_RESULTS_FRAME_SIZE)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(serializedWinners) == 0 {
 		// This agency has no winners
 		return []string{}, nil
 	}
 
-	serializedWinners, err := proto.socket.ReceiveAll(int(winnersLen))
-	if err != nil {
-		return nil, err
+	if !utf8.Valid(serializedWinners) {
+		return nil, errors.New("invalid winners list: not valid utf-8")
 	}
 
 	return strings.Split(string(serializedWinners), _WINNER_SEPARATOR), nil
 }
 
-func (proto *Protocol) SendBatch(batch []*Bet) error {
-	serializedBets := make([]string, 0, len(batch))
-	for _, bet := range batch {
-		serializedBet := proto.serializeBet(bet)
-		serializedBets = append(serializedBets, serializedBet)
+// ResumeUpload Identifies the agency whose bets are about to be sent and
+// returns what the server already stored from them. The sequence number of
+// the next batch must then be set with SetNextSeq. Must be called right after
+// StartSendingBets if the connection is Resumable
+func (proto *Protocol) ResumeUpload(ctx context.Context) (UploadStatus, error) {
+	if err := proto.socket.SendAll(ctx, proto.uint32ToBytes(proto.agencyId)); err != nil {
+		return UploadStatus{}, err
+	}
+
+	var status int
+	var lastSeq uint32
+	err := proto.receiveWithin("ack-wait", proto.options.Timeouts.Ack, func() error {
+		var err error
+		status, err = proto.receiveAction(ctx)
+		if err != nil {
+			return err
+		}
+		if status == _ERROR_CODE {
+			return proto.receiveError(ctx)
+		}
+
+		lastSeq, err = proto.receiveUint32(ctx)
+		return err
+	})
+	if err != nil {
+		return UploadStatus{}, err
 	}
 
-	serializedBatch := strings.Join(serializedBets, _BATCH_SEPARATOR)
-	totalSize := uint16(len(serializedBatch))
+	switch status {
+		case _UPLOAD_NOT_STARTED:
+			return UploadStatus{}, nil
+		case _UPLOAD_IN_PROGRESS:
+			return UploadStatus{HasCommitted: true, LastCommittedSeq: lastSeq}, nil
+		case _UPLOAD_COMPLETED:
+			return UploadStatus{Completed: true, HasCommitted: true, LastCommittedSeq: lastSeq}, nil
+		default:
+			return UploadStatus{}, fmt.Errorf("unexpected upload status received from server: %d", status)
+	}
+}
 
-	buf := proto.uint16ToBytes(totalSize)
-	buf = append(buf, serializedBatch...)
+// NextSeq Returns the sequence number that will be assigned to the next batch
+func (proto *Protocol) NextSeq() uint32 {
+	return proto.nextSeq
+}
 
-	return proto.socket.SendAll(buf)
+// SetNextSeq Sets the sequence number that will be assigned to the next batch
+func (proto *Protocol) SetNextSeq(seq uint32) {
+	proto.nextSeq = seq
 }
 
-func (proto *Protocol) WaitConfirmation() error {
-	action, err := proto.receiveAction()
+// SendBatch Sends the batch and returns the sequence number assigned to it,
+// which WaitConfirmation returns once the server acknowledges the batch
+func (proto *Protocol) SendBatch(ctx context.Context, batch []*Bet) (uint32, error) {
+	seq := proto.nextSeq
+
+	payload, err := proto.encodeBatch(seq, batch)
 	if err != nil {
+		return 0, err
+	}
+
+	if err := proto.sendFrame(ctx, payload); err != nil {
+		return 0, err
+	}
+
+	proto.nextSeq++
+	return seq, nil
+}
+
+// encodeBatch Returns the payload of the frame that carries the batch
+func (proto *Protocol) encodeBatch(seq uint32, batch []*Bet) ([]byte, error) {
+	serializedBatch := make([]byte, 0)
+	if proto.Idempotent() {
+		serializedBatch = append(serializedBatch, proto.uint32ToBytes(proto.agencyId)...)
+	}
+	if proto.sequenced() {
+		serializedBatch = append(serializedBatch, proto.uint32ToBytes(seq)...)
+	}
+	for _, bet := range batch {
+		serializedBet, err := proto.serializeBet(bet)
+		if err != nil {
+			return nil, err
+		}
+		serializedBatch = append(serializedBatch, serializedBet...)
+	}
+
+	if proto.Compressed() {
+		if proto.compressor == nil {
+			proto.compressor = newCompressor()
+		}
+
+		var err error
+		serializedBatch, err = proto.compressor.encode(serializedBatch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if proto.Checksummed() {
+		serializedBatch = appendChecksum(serializedBatch)
+	}
+
+	if uint64(len(serializedBatch)) > uint64(proto.maxFrameSize) {
+		return nil, fmt.Errorf("batch of %d bytes exceeds max frame size of %d bytes",
+			len(serializedBatch), proto.maxFrameSize)
+	}
+
+	return serializedBatch, nil
+}
+
+// WaitConfirmation Waits for the next acknowledgement from the server, which
+// refers to the batch with the returned sequence number. If batches are not
+// sequenced, they are acknowledged in the order they were sent
+func (proto *Protocol) WaitConfirmation(ctx context.Context) (Ack, error) {
+	var ack Ack
+	err := proto.receiveWithin("ack-wait", proto.options.Timeouts.Ack, func() error {
+		var err error
+		ack, err = proto.receiveAck(ctx)
 		return err
+	})
+	return ack, err
+}
+
+func (proto *Protocol) receiveAck(ctx context.Context) (Ack, error) {
+	action, err := proto.receiveAction(ctx)
+	if err != nil {
+		return Ack{}, err
 	}
 
+	ack := Ack{}
 	switch action {
 		case _BATCH_RECEIVED:
-			return nil
+		case _BATCH_ALREADY_STORED:
+			ack.AlreadyStored = true
+		case _BATCH_CORRUPTED:
+			return Ack{}, fmt.Errorf("%w: server received a corrupted batch", ErrChecksumMismatch)
 		case _ERROR_CODE:
-			return fmt.Errorf("error received from server")
+			return Ack{}, proto.receiveError(ctx)
 		default:
-			return fmt.Errorf("unexpected code received from server: %d", action)
+			return Ack{}, fmt.Errorf("unexpected code received from server: %d", action)
+	}
+
+	if proto.sequenced() {
+		ack.Seq, err = proto.receiveUint32(ctx)
+		return ack, err
 	}
+
+	ack.Seq = proto.nextAckSeq
+	proto.nextAckSeq++
+	return ack, nil
+}
+
+// InformCompletion Sends an empty frame, marking that there are no more bets
+func (proto *Protocol) InformCompletion(ctx context.Context) error {
+	return proto.sendFrame(ctx, nil)
+}
+
+func (proto *Protocol) sendFrame(ctx context.Context, payload []byte) error {
+	buf := make([]byte, 0, _FRAME_HEADER_SIZE+len(payload))
+	buf = append(buf, _FRAME_VERSION)
+	buf = append(buf, proto.uint32ToBytes(uint32(len(payload)))...)
+	buf = append(buf, payload...)
+
+	return proto.socket.SendAll(ctx, buf)
 }
 
-func (proto *Protocol) InformCompletion() error {
-	return proto.socket.SendAll(proto.uint16ToBytes(0))
+// receiveFrame Receives a frame and returns its payload, failing if the frame
+// version is unknown or its length is greater than maxSize
+func (proto *Protocol) receiveFrame(ctx context.Context, maxSize uint32) ([]byte, error) {
+	header, err := proto.socket.ReceiveAll(ctx, _FRAME_HEADER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0] != _FRAME_VERSION {
+		return nil, fmt.Errorf("unsupported frame version: %d", header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds max frame size of %d bytes", length, maxSize)
+	}
+
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	return proto.socket.ReceiveAll(ctx, int(length))
 }
 
 func (proto *Protocol) uint16ToBytes(value uint16) []byte {
@@ -140,19 +708,38 @@ func (proto *Protocol) uint16ToBytes(value uint16) []byte {
 	return buf
 }
 
-func (proto *Protocol) receiveAction() (int, error) {
-	buf, err := proto.socket.ReceiveAll(1)
+func (proto *Protocol) uint32ToBytes(value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return buf
+}
+
+// receiveWithin Runs receive with a read deadline of timeout from now, turning
+// the error into a TimeoutError for op if the deadline is exceeded
+func (proto *Protocol) receiveWithin(op string, timeout time.Duration, receive func() error) error {
+	if timeout > 0 {
+		if err := proto.socket.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer proto.socket.SetReadDeadline(time.Time{})
+	}
+
+	return asTimeoutError(receive(), op, timeout)
+}
+
+func (proto *Protocol) receiveAction(ctx context.Context) (int, error) {
+	buf, err := proto.socket.ReceiveAll(ctx, 1)
 	if err != nil {
 		return 0, err
 	}
 	return int(buf[0]), nil
 }
 
-func (proto *Protocol) receiveUint16() (uint16, error) {
-	buf, err := proto.socket.ReceiveAll(2)
+func (proto *Protocol) receiveUint32(ctx context.Context) (uint32, error) {
+	buf, err := proto.socket.ReceiveAll(ctx, 4)
 	if err != nil {
 		return 0, err
 	}
 
-	return binary.BigEndian.Uint16(buf), nil
+	return binary.BigEndian.Uint32(buf), nil
 }
\ No newline at end of file
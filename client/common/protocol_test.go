@@ -0,0 +1,42 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandshakeResetIsNotLegacy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			// Reads part of the HELLO and resets the connection
+			conn.Read(make([]byte, 1))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	timeouts := Timeouts{Connect: time.Second, Write: time.Second, Ack: time.Second, Results: time.Second}
+	proto, err := NewProtocol(context.Background(), listener.Addr().String(), ProtocolOptions{Timeouts: timeouts})
+	if err == nil {
+		proto.Close()
+		t.Fatal("expected a reset during the handshake to fail")
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Fatalf("expected no reconnection to speak the legacy protocol, got %d connections", n)
+	}
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy Defines how long to wait between consecutive attempts of an
+// operation. The delay starts at InitialDelay and is multiplied by Multiplier
+// after every attempt, up to MaxDelay. Each delay is then randomly shifted by
+// up to Jitter times its value, so agencies do not retry all at once
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	Jitter       float64
+	// MaxAttempts is the amount of attempts before giving up, or 0 to
+	// retry forever
+	MaxAttempts int
+}
+
+// Delay Returns how long to wait after the given attempt, starting from 1
+func (p RetryPolicy) Delay(attempt int, rng *rand.Rand) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rng.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Exhausted Returns true if no more attempts should be made after the given one
+func (p RetryPolicy) Exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
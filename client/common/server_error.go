@@ -0,0 +1,101 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// ErrorCode Identifies why the server rejected a request
+type ErrorCode uint8
+
+const (
+	ErrorUnknown ErrorCode = iota
+	ErrorMalformedMessage
+	ErrorInvalidBet
+	ErrorOutOfOrderBatch
+	ErrorAgencyMismatch
+	ErrorAuthenticationFailed
+)
+
+func (code ErrorCode) String() string {
+	switch code {
+	case ErrorMalformedMessage:
+		return "malformed_message"
+	case ErrorInvalidBet:
+		return "invalid_bet"
+	case ErrorOutOfOrderBatch:
+		return "out_of_order_batch"
+	case ErrorAgencyMismatch:
+		return "agency_mismatch"
+	case ErrorAuthenticationFailed:
+		return "authentication_failed"
+	default:
+		return "unknown"
+	}
+}
+
+// with structured errors, _ERROR_CODE is followed by the error code, the
+// sequence number of the batch and the index of the bet within it the
+// error refers to, and a uint16 length-prefixed message. The batch and
+// bet are _NOT_APPLICABLE if the error does not refer to them
+const _STRUCTURED_ERROR_SIZE = 1 + _SEQUENCE_NUMBER_SIZE + 4 + _FIELD_LENGTH_SIZE
+const _NOT_APPLICABLE = 0xFFFFFFFF
+
+// ServerError An error reported by the server
+type ServerError struct {
+	Code ErrorCode
+	// Seq is the sequence number of the rejected batch, if HasSeq
+	Seq    uint32
+	HasSeq bool
+	// BetIndex is the position within the batch of the rejected bet, or -1
+	// if the error does not refer to a single bet
+	BetIndex int
+	Message  string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return "error received from server"
+	}
+
+	location := ""
+	if e.HasSeq {
+		location = fmt.Sprintf(" in batch %d", e.Seq)
+	}
+	if e.BetIndex >= 0 {
+		location += fmt.Sprintf(" at bet %d", e.BetIndex)
+	}
+	return fmt.Sprintf("server error %v%v: %v", e.Code, location, e.Message)
+}
+
+// receiveError Receives the details of the error the server reported after
+// _ERROR_CODE. Without structured errors there are no details
+func (proto *Protocol) receiveError(ctx context.Context) error {
+	if !proto.supports(_FEATURE_STRUCTURED_ERRORS) {
+		return &ServerError{Code: ErrorUnknown, BetIndex: -1}
+	}
+
+	header, err := proto.socket.ReceiveAll(ctx, _STRUCTURED_ERROR_SIZE)
+	if err != nil {
+		return err
+	}
+
+	serverErr := &ServerError{Code: ErrorCode(header[0]), BetIndex: -1}
+	if seq := binary.BigEndian.Uint32(header[1:]); seq != _NOT_APPLICABLE {
+		serverErr.Seq, serverErr.HasSeq = seq, true
+	}
+	if index := binary.BigEndian.Uint32(header[5:]); index != _NOT_APPLICABLE {
+		serverErr.BetIndex = int(index)
+	}
+
+	length := binary.BigEndian.Uint16(header[9:])
+	if length > 0 {
+		message, err := proto.socket.ReceiveAll(ctx, int(length))
+		if err != nil {
+			return err
+		}
+		serverErr.Message = string(message)
+	}
+	return serverErr
+}
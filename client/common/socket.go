@@ -1,47 +1,213 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 )
 
+// bytes ReceiveAll allocates before the peer starts sending them
+const _RECEIVE_CHUNK_SIZE = 64 * 1024
+
+// TimeoutError Returned when an operation with the server does not complete
+// within its configured timeout. Op identifies the operation, such as
+// "connect", "write", "ack-wait" or "results-wait"
+type TimeoutError struct {
+	Op    string
+	Limit time.Duration
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v timed out after %v: %v", e.Op, e.Limit, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout Always true, so TimeoutError implements net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary Always true, so TimeoutError implements net.Error
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// asTimeoutError Wraps err in a TimeoutError if it was caused by a deadline.
+// Errors caused by a context are returned as they are
+func asTimeoutError(err error, op string, timeout time.Duration) error {
+	if isContextError(err) {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Op: op, Limit: timeout, Err: err}
+	}
+	return err
+}
+
+// isContextError Returns true if err comes from a cancelled or expired context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// a deadline already exceeded, used to interrupt blocked reads and writes
+var _PAST_DEADLINE = time.Unix(1, 0)
+
 // Implements a TCP socket connection.
 type Socket struct {
 	conn net.Conn
+	writeTimeout time.Duration
+	closeOnce sync.Once
+	closeErr error
 }
 
-func Connect(address string) (*Socket, error) {
-	conn, err := net.Dial("tcp", address)
+// Connect Connects to the address, failing with a TimeoutError if the
+// connection is not established within connectTimeout. Every write fails
+// with a TimeoutError if it does not complete within writeTimeout. A zero
+// timeout means no timeout. If ctx is cancelled first, its error is returned.
+// If tlsConfig is not nil, the connection is encrypted with TLS, and the
+// handshake must also complete within connectTimeout
+func Connect(ctx context.Context, address string, tlsConfig *tls.Config, connectTimeout time.Duration, writeTimeout time.Duration) (*Socket, error) {
+	netDialer := &net.Dialer{Timeout: connectTimeout}
+
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		dialer := tls.Dialer{NetDialer: netDialer, Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = netDialer.DialContext(ctx, "tcp", address)
+	}
+
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// The TLS handshake fails with the error of the context bounded
+		// by connectTimeout
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &TimeoutError{Op: "connect", Limit: connectTimeout, Err: err}
+		}
+		return nil, asTimeoutError(err, "connect", connectTimeout)
 	}
-	return &Socket{conn: conn}, nil
+	return &Socket{conn: conn, writeTimeout: writeTimeout}, nil
 }
 
+// Close Closes the connection. It is safe to call it more than once, even
+// concurrently
 func (s *Socket) Close() error {
-	return s.conn.Close()
+	s.closeOnce.Do(func() {
+		s.closeErr = s.conn.Close()
+	})
+	return s.closeErr
+}
+
+// interruptOnDone Makes the blocked reads or writes fail, by moving their
+// deadline to the past, as soon as ctx is done. The returned function must be
+// called once the operation completes: it waits for the watcher to stop and
+// clears the deadline if it was moved, so later operations on the socket are
+// not interrupted
+func (s *Socket) interruptOnDone(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	finished := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(_PAST_DEADLINE)
+			interrupted <- true
+		case <-finished:
+			interrupted <- false
+		}
+	}()
+	return func() {
+		close(finished)
+		if <-interrupted {
+			setDeadline(time.Time{})
+		}
+	}
+}
+
+// SetReadDeadline Sets the deadline for the following reads. A zero value
+// means reads never time out
+func (s *Socket) SetReadDeadline(deadline time.Time) error {
+	return s.conn.SetReadDeadline(deadline)
 }
 
-func (s *Socket) SendAll(data []byte) error {
+// SendAll Writes all the data, unless ctx is cancelled first, in which case
+// its error is returned
+func (s *Socket) SendAll(ctx context.Context, data []byte) error {
+	if s.writeTimeout > 0 {
+		if err := s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			return err
+		}
+	}
+
+	defer s.interruptOnDone(ctx, s.conn.SetWriteDeadline)()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	totalSent := 0
 	for totalSent < len(data) {
 		n, err := s.conn.Write(data[totalSent:])
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return asTimeoutError(err, "write", s.writeTimeout)
 		}
 		totalSent += n
 	}
 	return nil
 }
 
-func (s *Socket) ReceiveAll(len int) ([]byte, error) {
-	buf := make([]byte, len)
+// ReceiveAll Reads exactly len bytes, unless ctx is cancelled first, in
+// which case its error is returned
+func (s *Socket) ReceiveAll(ctx context.Context, len int) ([]byte, error) {
+	defer s.interruptOnDone(ctx, s.conn.SetReadDeadline)()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The buffer doubles as bytes arrive, so a length announced by a
+	// misbehaving peer is not allocated until it is actually sent
+	size := len
+	if size > _RECEIVE_CHUNK_SIZE {
+		size = _RECEIVE_CHUNK_SIZE
+	}
+	buf := make([]byte, size)
 	totalReceived := 0
 	for totalReceived < len {
+		if totalReceived == size {
+			size *= 2
+			if size > len {
+				size = len
+			}
+			grown := make([]byte, size)
+			copy(grown, buf)
+			buf = grown
+		}
 		n, err := s.conn.Read(buf[totalReceived:])
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			return nil, err
 		}
 		totalReceived += n
 	}
 	return buf, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startPlainEchoServer Starts a listener on loopback that echoes every byte
+// it receives
+func startPlainEchoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestSocketCanBeReusedAfterCancel(t *testing.T) {
+	socket, err := Connect(context.Background(), startPlainEchoServer(t), nil, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	// Nothing is echoed until something is sent, so the read blocks until
+	// it is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := socket.ReceiveAll(ctx, 4); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the read to be cancelled, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err := socket.SendAll(ctx, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := socket.ReceiveAll(ctx, 4)
+	if err != nil || string(reply) != "ping" {
+		t.Fatalf("expected the socket to be usable after a cancelled read, got %q and %v", reply, err)
+	}
+}
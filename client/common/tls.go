@@ -0,0 +1,64 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions How the connection with the server is encrypted. If Enabled is
+// false the connection is plain TCP
+type TLSOptions struct {
+	Enabled bool
+	// CAFile is a PEM bundle with the certificates used to verify the
+	// server. The system roots are used if empty
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and its key,
+	// presented to servers that require mutual authentication
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the server certificate is verified
+	// against, which is the host of the server address by default
+	ServerName string
+}
+
+// ClientConfig Builds the configuration used to connect to the server, or
+// returns nil if TLS is disabled
+func (o TLSOptions) ClientConfig() (*tls.Config, error) {
+	if !o.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: o.ServerName,
+	}
+
+	if o.CAFile != "" {
+		bundle, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %v", o.CAFile)
+		}
+		config.RootCAs = roots
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,284 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA A certificate authority that issues the certificates used in the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue Returns a certificate signed by the CA, along with its key, both
+// PEM encoded. The certificate is valid for the given DNS names and IPs
+func (ca *testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage, dnsNames []string, ips []net.IP) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startEchoServer Starts a TLS listener on loopback that echoes every byte it
+// receives. If clientCAs is not nil, clients must present a certificate
+// signed by one of them
+func startEchoServer(t *testing.T, certPEM []byte, keyPEM []byte, clientCAs *x509.CertPool) string {
+	t.Helper()
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// roundTrip Connects to the echo server and checks a message comes back intact
+func roundTrip(address string, options TLSOptions) error {
+	config, err := options.ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	socket, err := Connect(ctx, address, config, 5*time.Second, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	message := []byte("Santiago Lionel|Lorca|30904465|1999-03-17|7574")
+	if err := socket.SendAll(ctx, message); err != nil {
+		return err
+	}
+
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := socket.ReceiveAll(ctx, len(message))
+	if err != nil {
+		return err
+	}
+	if string(reply) != string(message) {
+		return fmt.Errorf("echoed %q instead of %q", reply, message)
+	}
+	return nil
+}
+
+func TestTLSConnectsWithCustomCA(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, x509.ExtKeyUsageServerAuth, nil, []net.IP{net.ParseIP("127.0.0.1")})
+	address := startEchoServer(t, certPEM, keyPEM, nil)
+	caFile := writeFile(t, t.TempDir(), "ca.pem", ca.pem)
+
+	if err := roundTrip(address, TLSOptions{Enabled: true, CAFile: caFile}); err != nil {
+		t.Fatalf("expected connection to succeed, got %v", err)
+	}
+}
+
+func TestTLSRejectsUnknownAuthority(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, x509.ExtKeyUsageServerAuth, nil, []net.IP{net.ParseIP("127.0.0.1")})
+	address := startEchoServer(t, certPEM, keyPEM, nil)
+	otherCAFile := writeFile(t, t.TempDir(), "other-ca.pem", newTestCA(t).pem)
+
+	err := roundTrip(address, TLSOptions{Enabled: true, CAFile: otherCAFile})
+	if err == nil {
+		t.Fatal("expected a certificate signed by another CA to be rejected")
+	}
+	if isConnectionError(err) {
+		t.Fatalf("expected a verification error not to be retried, got %v", err)
+	}
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, x509.ExtKeyUsageServerAuth, []string{"server"}, nil)
+	address := startEchoServer(t, certPEM, keyPEM, nil)
+	caFile := writeFile(t, t.TempDir(), "ca.pem", ca.pem)
+
+	if err := roundTrip(address, TLSOptions{Enabled: true, CAFile: caFile}); err == nil {
+		t.Fatal("expected the certificate not to be valid for the server address")
+	}
+
+	options := TLSOptions{Enabled: true, CAFile: caFile, ServerName: "server"}
+	if err := roundTrip(address, options); err != nil {
+		t.Fatalf("expected connection to succeed with the server name override, got %v", err)
+	}
+}
+
+func TestTLSMutualAuthentication(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	serverCert, serverKey := ca.issue(t, 2, x509.ExtKeyUsageServerAuth, nil, []net.IP{net.ParseIP("127.0.0.1")})
+	clientCert, clientKey := ca.issue(t, 3, x509.ExtKeyUsageClientAuth, nil, nil)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	address := startEchoServer(t, serverCert, serverKey, clientCAs)
+
+	options := TLSOptions{
+		Enabled:  true,
+		CAFile:   writeFile(t, dir, "ca.pem", ca.pem),
+		CertFile: writeFile(t, dir, "client.pem", clientCert),
+		KeyFile:  writeFile(t, dir, "client-key.pem", clientKey),
+	}
+	if err := roundTrip(address, options); err != nil {
+		t.Fatalf("expected connection with client certificate to succeed, got %v", err)
+	}
+
+	// With TLS 1.3 the server rejects the missing certificate after the
+	// client considers the handshake complete, so the echo fails instead
+	options.CertFile, options.KeyFile = "", ""
+	if err := roundTrip(address, options); err == nil {
+		t.Fatal("expected connection without client certificate to fail")
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := writeFile(t, dir, "ca.pem", ca.pem)
+	notPEM := writeFile(t, dir, "not.pem", []byte("not a certificate"))
+
+	tests := []struct {
+		name    string
+		options TLSOptions
+		wantErr bool
+	}{
+		{"disabled", TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, false},
+		{"system roots", TLSOptions{Enabled: true}, false},
+		{"custom CA", TLSOptions{Enabled: true, CAFile: caFile}, false},
+		{"missing CA bundle", TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "missing.pem")}, true},
+		{"empty CA bundle", TLSOptions{Enabled: true, CAFile: notPEM}, true},
+		{"certificate without key", TLSOptions{Enabled: true, CertFile: caFile}, true},
+		{"invalid client certificate", TLSOptions{Enabled: true, CertFile: notPEM, KeyFile: notPEM}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := test.options.ClientConfig()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error: %v, got %v", test.wantErr, err)
+			}
+			if err == nil && (config == nil) == test.options.Enabled {
+				t.Fatalf("expected config only when TLS is enabled, got %v", config)
+			}
+		})
+	}
+}
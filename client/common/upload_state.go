@@ -0,0 +1,247 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// acknowledgements recorded in memory before the state is saved, unless
+// _STATE_SAVE_INTERVAL elapses first
+const _STATE_SAVE_EVERY = 8
+const _STATE_SAVE_INTERVAL = time.Second
+
+// batchProgress The amount of csv records consumed once a batch was sent, and
+// how many of them were rejected
+type batchProgress struct {
+	Line     int `json:"line"`
+	Rejected int `json:"rejected"`
+}
+
+// ackedBatch The last batch acknowledged by the server, along with the
+// progress once it was sent
+type ackedBatch struct {
+	Seq uint32 `json:"seq"`
+	batchProgress
+}
+
+// UploadState Progress of the upload of the bets of an agency, persisted in a
+// file so it can be resumed after a dropped connection or a restart. For every
+// batch it keeps the amount of csv records consumed once the batch was sent, so
+// the upload can continue right after the last batch committed by the server,
+// and how many of them were rejected, so the reject ratio covers the records
+// skipped. Batches are recorded in memory, and the state is saved after
+// several acknowledgements and when flushed, so the saved state may be
+// behind the batches stored by the server. A nil *UploadState is valid and
+// persists nothing
+type UploadState struct {
+	path string
+	// acknowledgements recorded since the state was saved, and when it was
+	unsaved int
+	savedAt time.Time
+
+	Agency string `json:"agency"`
+	Source string `json:"source"`
+	// Fingerprint identifies the content of the source, so the records
+	// consumed are not counted on a different one
+	Fingerprint string                   `json:"fingerprint"`
+	LastAcked   *ackedBatch              `json:"lastAcked,omitempty"`
+	InFlight    map[uint32]batchProgress `json:"inFlight"`
+}
+
+// LoadUploadState Loads the upload state stored in path. If the file does not
+// exist or belongs to another agency or source, an empty state is returned.
+// If the source has a different fingerprint than when the state was saved,
+// it can not be resumed and an error is returned
+func LoadUploadState(path string, agency string, source string, fingerprint string) (*UploadState, error) {
+	state := &UploadState{
+		path:        path,
+		Agency:      agency,
+		Source:      source,
+		Fingerprint: fingerprint,
+		InFlight:    make(map[uint32]batchProgress),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &UploadState{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("invalid upload state file %v: %w", path, err)
+	}
+
+	if stored.Agency != agency || stored.Source != source {
+		return state, nil
+	}
+	if stored.Fingerprint != fingerprint {
+		return nil, fmt.Errorf("bets files changed since upload state %v was saved, it must be removed to upload them again", path)
+	}
+
+	stored.path = path
+	if stored.InFlight == nil {
+		stored.InFlight = make(map[uint32]batchProgress)
+	}
+	return stored, nil
+}
+
+// LineAfter Returns the amount of csv records consumed once the batch with the
+// given sequence number was sent and how many of them were rejected, if the
+// batch is known
+func (s *UploadState) LineAfter(seq uint32) (int, int, bool) {
+	if s == nil {
+		return 0, 0, false
+	}
+
+	if s.LastAcked != nil && s.LastAcked.Seq == seq {
+		return s.LastAcked.Line, s.LastAcked.Rejected, true
+	}
+
+	progress, found := s.InFlight[seq]
+	return progress.Line, progress.Rejected, found
+}
+
+// Resuming Returns true if the state holds the progress of an upload that
+// did not finish
+func (s *UploadState) Resuming() bool {
+	return s != nil && (s.LastAcked != nil || len(s.InFlight) > 0)
+}
+
+// LastSavedBefore Returns the sequence number of the batch after the last one
+// acknowledged before seq, along with the progress once that batch was sent,
+// or zeros if there is none. The upload can continue from there if the
+// server stored batches unknown to the state
+func (s *UploadState) LastSavedBefore(seq uint32) (uint32, int, int) {
+	if s == nil || s.LastAcked == nil || s.LastAcked.Seq >= seq {
+		return 0, 0, 0
+	}
+	return s.LastAcked.Seq + 1, s.LastAcked.Line, s.LastAcked.Rejected
+}
+
+// RecordSent Records in memory a batch that is about to be sent, after
+// consuming line csv records of which rejected were rejected. It is saved
+// along with the following acknowledgements
+func (s *UploadState) RecordSent(seq uint32, line int, rejected int) {
+	if s == nil {
+		return
+	}
+
+	s.InFlight[seq] = batchProgress{Line: line, Rejected: rejected}
+}
+
+// RecordAck Records that the server stored the batch with the given sequence
+// number, and therefore every batch sent before it. The state is saved once
+// every _STATE_SAVE_EVERY acknowledgements or _STATE_SAVE_INTERVAL
+func (s *UploadState) RecordAck(seq uint32) error {
+	if err := s.recordAck(seq); err != nil || s == nil {
+		return err
+	}
+
+	s.unsaved++
+	if s.unsaved < _STATE_SAVE_EVERY && time.Since(s.savedAt) < _STATE_SAVE_INTERVAL {
+		return nil
+	}
+	return s.save()
+}
+
+// Flush Saves the acknowledgements recorded since the state was last saved
+func (s *UploadState) Flush() error {
+	if s == nil || s.unsaved == 0 {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *UploadState) recordAck(seq uint32) error {
+	if s == nil {
+		return nil
+	}
+
+	line, rejected, found := s.LineAfter(seq)
+	if !found {
+		return fmt.Errorf("acknowledged batch %d was never sent", seq)
+	}
+
+	s.LastAcked = &ackedBatch{Seq: seq, batchProgress: batchProgress{Line: line, Rejected: rejected}}
+	for inFlight := range s.InFlight {
+		if inFlight <= seq {
+			delete(s.InFlight, inFlight)
+		}
+	}
+	return nil
+}
+
+// Rewind Discards every batch sent after the given one, which will be sent
+// again, and saves the state. If committed is false, no batch was stored by
+// the server
+func (s *UploadState) Rewind(seq uint32, committed bool) error {
+	if s == nil {
+		return nil
+	}
+
+	if !committed {
+		s.LastAcked = nil
+		s.InFlight = make(map[uint32]batchProgress)
+		return s.save()
+	}
+
+	if err := s.recordAck(seq); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Remove Deletes the state file, once the upload finished
+func (s *UploadState) Remove() error {
+	if s == nil {
+		return nil
+	}
+
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// save Writes the state to a temporary file and then renames it, so a crash
+// never leaves a partially written state file
+func (s *UploadState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	// Flushed before renaming, so a crash never leaves the new name pointing
+	// to data that did not reach the disk
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), s.path); err != nil {
+		return err
+	}
+	s.unsaved, s.savedAt = 0, time.Now()
+	return nil
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
@@ -38,6 +41,71 @@ func InitConfig() (*viper.Viper, error) {
 	v.BindEnv("server", "address")
 	v.BindEnv("log", "level")
 
+	// Optional TLS for the connection with the server
+	v.SetDefault("server.tls.enabled", false)
+	v.SetDefault("server.tls.caFile", "")
+	v.SetDefault("server.tls.certFile", "")
+	v.SetDefault("server.tls.keyFile", "")
+	v.SetDefault("server.tls.serverName", "")
+	// File with the secret the agency authenticates with. Only its path is
+	// part of the configuration, so the secret itself is never logged
+	v.SetDefault("auth.secretFile", "")
+
+	// Comma separated list of files with the bets: paths, globs, "-" for
+	// stdin, .gz files and .zip archives, optionally followed by #pattern to
+	// choose their members
+	v.SetDefault("bets.file", "/agency.csv")
+	// Format of the bets files, csv or jsonl. If empty, files ending in
+	// .jsonl or .ndjson are read as JSON Lines and any other as csv
+	v.SetDefault("bets.format", "")
+	// Layout of the csv with the bets. Columns are looked up by name only if
+	// the csv has a header row
+	csvDefaults := common.DefaultCSVOptions()
+	v.SetDefault("csv.delimiter", string(csvDefaults.Delimiter))
+	v.SetDefault("csv.header", csvDefaults.Header)
+	v.SetDefault("csv.columns.firstName", csvDefaults.Columns.FirstName)
+	v.SetDefault("csv.columns.lastName", csvDefaults.Columns.LastName)
+	v.SetDefault("csv.columns.document", csvDefaults.Columns.Document)
+	v.SetDefault("csv.columns.birthdate", csvDefaults.Columns.Birthdate)
+	v.SetDefault("csv.columns.number", csvDefaults.Columns.Number)
+
+	// Bounds the bets must respect to be sent, and what to do with the ones
+	// that do not: strict, skip or quarantine. An empty maxBirthdate is today
+	v.SetDefault("validation.mode", "strict")
+	v.SetDefault("validation.quarantineFile", "")
+	v.SetDefault("validation.minBirthdate", "1900-01-01")
+	v.SetDefault("validation.maxBirthdate", "")
+	v.SetDefault("validation.minDocument", 1)
+	v.SetDefault("validation.maxDocument", 99999999)
+	v.SetDefault("validation.minNumber", 0)
+	v.SetDefault("validation.maxNumber", 9999)
+	v.SetDefault("validation.maxFieldLength", 100)
+	// Fraction of csv rows that can be rejected without failing the upload
+	v.SetDefault("validation.maxRejectRatio", 1)
+
+	// Maximum size in bytes of a serialized batch. The server may negotiate a smaller one
+	v.SetDefault("batch.maxSize", 8*1024)
+	// Amount of batches sent without waiting for their confirmation
+	v.SetDefault("batch.window", 1)
+	// Offer the server to compress batches with gzip
+	v.SetDefault("batch.compression", true)
+	// File where the upload progress is persisted to resume it. Disabled if empty
+	v.SetDefault("resume.stateFile", "")
+	v.SetDefault("resume.maxRetries", 3)
+	// Exponential backoff used to reconnect to the server and poll for the winners
+	v.SetDefault("retry.initialDelay", "500ms")
+	v.SetDefault("retry.multiplier", 2)
+	v.SetDefault("retry.maxDelay", "5s")
+	v.SetDefault("retry.jitter", 0.2)
+	v.SetDefault("retry.maxAttempts", 10)
+	// Maximum time to connect, send a message and wait for each answer of the server
+	v.SetDefault("timeout.connect", "5s")
+	v.SetDefault("timeout.write", "10s")
+	v.SetDefault("timeout.ack", "30s")
+	v.SetDefault("timeout.results", "30s")
+	// Time given to the batches in flight to be acknowledged after SIGTERM or SIGINT
+	v.SetDefault("shutdown.gracePeriod", "5s")
+
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
 	// can be loaded from the environment variables so we shouldn't
@@ -47,15 +115,129 @@ func InitConfig() (*viper.Viper, error) {
 		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
 	}
 
+	if maxSize := v.GetInt64("batch.maxSize"); maxSize <= 0 || maxSize > math.MaxUint32 {
+		return nil, errors.Errorf("Invalid batch.maxSize %d, it must be between 1 and %d bytes", maxSize, uint32(math.MaxUint32))
+	}
+
+	if format := v.GetString("bets.format"); format != "" && format != common.FormatCSV && format != common.FormatJSONL {
+		return nil, errors.Errorf("Invalid bets.format %q, it must be %v, %v or empty", format, common.FormatCSV, common.FormatJSONL)
+	}
+
+	if delimiter := []rune(v.GetString("csv.delimiter")); len(delimiter) != 1 || !validDelimiter(delimiter[0]) {
+		return nil, errors.Errorf("Invalid csv.delimiter %q, it must be a single character other than a quote or a line break", v.GetString("csv.delimiter"))
+	}
+
+	if mode, err := common.ParseValidationMode(v.GetString("validation.mode")); err != nil {
+		return nil, errors.Wrapf(err, "Invalid validation.mode")
+	} else if mode == common.ValidationQuarantine && v.GetString("validation.quarantineFile") == "" {
+		return nil, errors.Errorf("validation.quarantineFile is required in quarantine mode")
+	}
+
+	if ratio := v.GetFloat64("validation.maxRejectRatio"); ratio < 0 || ratio > 1 {
+		return nil, errors.Errorf("Invalid validation.maxRejectRatio %v, it must be between 0 and 1", ratio)
+	}
+
+	if window := v.GetInt("batch.window"); window < 1 {
+		return nil, errors.Errorf("Invalid batch.window %d, it must be at least 1", window)
+	}
+
+	if multiplier := v.GetFloat64("retry.multiplier"); multiplier < 1 {
+		return nil, errors.Errorf("Invalid retry.multiplier %v, it must be at least 1", multiplier)
+	}
+
+	if jitter := v.GetFloat64("retry.jitter"); jitter < 0 || jitter > 1 {
+		return nil, errors.Errorf("Invalid retry.jitter %v, it must be between 0 and 1", jitter)
+	}
+
+	if maxAttempts := v.GetInt("retry.maxAttempts"); maxAttempts < 0 {
+		return nil, errors.Errorf("Invalid retry.maxAttempts %d, it must be 0 (unlimited) or greater", maxAttempts)
+	}
+
 	// Parse time.Duration variables and return an error if those variables cannot be parsed
 
 	if _, err := time.ParseDuration(v.GetString("loop.period")); err != nil {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
 
+	if _, err := time.ParseDuration(v.GetString("retry.initialDelay")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_RETRY_INITIALDELAY env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("retry.maxDelay")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_RETRY_MAXDELAY env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("shutdown.gracePeriod")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SHUTDOWN_GRACEPERIOD env var as time.Duration.")
+	}
+
+	for _, key := range []string{"timeout.connect", "timeout.write", "timeout.ack", "timeout.results"} {
+		timeout, err := time.ParseDuration(v.GetString(key))
+		if err != nil {
+			envVar := "CLI_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+			return nil, errors.Wrapf(err, "Could not parse %s env var as time.Duration.", envVar)
+		}
+		if timeout < 0 {
+			return nil, errors.Errorf("Invalid %s %v, it must be 0 (no timeout) or greater", key, timeout)
+		}
+	}
+
 	return v, nil
 }
 
+// ValidationRules Builds the rules the bets are validated with from the
+// validation section of the configuration
+func ValidationRules(v *viper.Viper) (common.ValidationRules, error) {
+	rules := common.DefaultValidationRules()
+
+	for _, date := range []struct {
+		key    string
+		target *time.Time
+	}{
+		{"validation.minBirthdate", &rules.MinBirthdate},
+		{"validation.maxBirthdate", &rules.MaxBirthdate},
+	} {
+		value := v.GetString(date.key)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return rules, errors.Wrapf(err, "Invalid %s %q, it must be a YYYY-MM-DD date", date.key, value)
+		}
+		*date.target = parsed
+	}
+	if rules.MinBirthdate.After(rules.MaxBirthdate) {
+		return rules, errors.Errorf("Invalid validation.minBirthdate, it is after validation.maxBirthdate")
+	}
+
+	for _, bounds := range []struct {
+		name     string
+		min, max *uint64
+	}{
+		{"Document", &rules.MinDocument, &rules.MaxDocument},
+		{"Number", &rules.MinNumber, &rules.MaxNumber},
+	} {
+		min, max := v.GetInt64("validation.min"+bounds.name), v.GetInt64("validation.max"+bounds.name)
+		if min < 0 || min > max {
+			return rules, errors.Errorf("Invalid validation.min%s %d and validation.max%s %d, they must be non negative and min must not exceed max",
+				bounds.name, min, bounds.name, max)
+		}
+		*bounds.min, *bounds.max = uint64(min), uint64(max)
+	}
+
+	rules.MaxFieldLength = v.GetInt("validation.maxFieldLength")
+	if rules.MaxFieldLength < 1 {
+		return rules, errors.Errorf("Invalid validation.maxFieldLength %d, it must be at least 1", rules.MaxFieldLength)
+	}
+	return rules, nil
+}
+
+// validDelimiter Reports whether r can separate the fields of the csv
+func validDelimiter(r rune) bool {
+	return r != '"' && r != '\r' && r != '\n' && r != utf8.RuneError
+}
+
 // InitLogger Receives the log level to be set in go-logging as a string. This method
 // parses the string and set the level to the logger. If the level string is not
 // valid an error is returned
@@ -81,9 +263,12 @@ func InitLogger(logLevel string) error {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | log_level: %s",
+	log.Infof("action: config | result: success | client_id: %s | server_address: %s | bets_file: %s | tls: %v | auth: %v | log_level: %s",
 		v.GetString("id"),
 		v.GetString("server.address"),
+		v.GetString("bets.file"),
+		v.GetBool("server.tls.enabled"),
+		v.GetString("auth.secretFile") != "",
 		v.GetString("log.level"),
 	)
 }
@@ -101,27 +286,98 @@ func main() {
 	// Print program config with debugging purposes
 	PrintConfig(v)
 
-	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		BatchAmount:   v.GetInt("batch.maxAmount"),
+	tlsOptions := common.TLSOptions{
+		Enabled:    v.GetBool("server.tls.enabled"),
+		CAFile:     v.GetString("server.tls.caFile"),
+		CertFile:   v.GetString("server.tls.certFile"),
+		KeyFile:    v.GetString("server.tls.keyFile"),
+		ServerName: v.GetString("server.tls.serverName"),
+	}
+	tlsConfig, err := tlsOptions.ClientConfig()
+	if err != nil {
+		log.Criticalf("action: load_tls_config | result: fail | client_id: %v | error: %v", v.GetString("id"), err)
+		return
 	}
 
-	client := common.NewClient(clientConfig)
-	if client == nil {
-		log.Criticalf("action: create_client | result: fail | error: %s", err)
+	agencySecret, err := common.LoadAgencySecret(v.GetString("auth.secretFile"))
+	if err != nil {
+		log.Criticalf("action: load_agency_secret | result: fail | client_id: %v | error: %v", v.GetString("id"), err)
 		return
 	}
 
+	validationRules, err := ValidationRules(v)
+	if err != nil {
+		log.Criticalf("action: load_validation_rules | result: fail | client_id: %v | error: %v", v.GetString("id"), err)
+		return
+	}
+	validationMode, _ := common.ParseValidationMode(v.GetString("validation.mode"))
+
+	clientConfig := common.ClientConfig{
+		ServerAddress:    v.GetString("server.address"),
+		BetsFiles:        v.GetString("bets.file"),
+		TLS:              tlsConfig,
+		ID:               v.GetString("id"),
+		BatchAmount:      v.GetInt("batch.maxAmount"),
+		BatchMaxSize:     v.GetInt("batch.maxSize"),
+		BatchWindow:      v.GetInt("batch.window"),
+		Compression:      v.GetBool("batch.compression"),
+		ResumeStateFile:  v.GetString("resume.stateFile"),
+		ResumeMaxRetries: v.GetInt("resume.maxRetries"),
+		Retry: common.RetryPolicy{
+			InitialDelay: v.GetDuration("retry.initialDelay"),
+			Multiplier:   v.GetFloat64("retry.multiplier"),
+			MaxDelay:     v.GetDuration("retry.maxDelay"),
+			Jitter:       v.GetFloat64("retry.jitter"),
+			MaxAttempts:  v.GetInt("retry.maxAttempts"),
+		},
+		Timeouts: common.Timeouts{
+			Connect: v.GetDuration("timeout.connect"),
+			Write:   v.GetDuration("timeout.write"),
+			Ack:     v.GetDuration("timeout.ack"),
+			Results: v.GetDuration("timeout.results"),
+		},
+		AgencySecret:        agencySecret,
+		ShutdownGracePeriod: v.GetDuration("shutdown.gracePeriod"),
+		ValidationRules:     validationRules,
+		ValidationMode:      validationMode,
+		QuarantineFile:      v.GetString("validation.quarantineFile"),
+		MaxRejectRatio:      v.GetFloat64("validation.maxRejectRatio"),
+		BetsFormat:          v.GetString("bets.format"),
+		CSV: common.CSVOptions{
+			Delimiter: []rune(v.GetString("csv.delimiter"))[0],
+			Header:    v.GetBool("csv.header"),
+			Columns: common.CSVColumns{
+				FirstName: v.GetString("csv.columns.firstName"),
+				LastName:  v.GetString("csv.columns.lastName"),
+				Document:  v.GetString("csv.columns.document"),
+				Birthdate: v.GetString("csv.columns.birthdate"),
+				Number:    v.GetString("csv.columns.number"),
+			},
+		},
+	}
+
+	client := common.NewClient(clientConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGTERM)
+	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGINT)
 
 	go func() {
-		<-signalChannel
-		log.Infof("action: sigterm_received | result: success | client_id: %v", clientConfig.ID)
-		client.Stop()
+		sig := <-signalChannel
+		log.Infof("action: signal_received | result: success | client_id: %v | signal: %v", clientConfig.ID, sig)
+		cancel()
 	}()
 
-	client.Start()
+	err = client.Start(ctx)
+	if errors.Is(err, context.Canceled) {
+		log.Infof("action: exit | result: success | client_id: %v | info: stopped by signal", clientConfig.ID)
+		return
+	}
+	if err != nil {
+		log.Criticalf("action: exit | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+		return
+	}
 	log.Infof("action: exit | result: success | client_id: %v", clientConfig.ID)
 }
@@ -32,6 +32,7 @@ for i in $(seq 1 $2); do
     volumes:
       - ./client/config.yaml:/config.yaml
       - ./.data/agency-$i.csv:/agency.csv
+      - ./.data/client$i:/state
     networks:
       - testing_net
     depends_on:
@@ -1,12 +1,21 @@
+import hashlib
+import hmac
 import logging
+import os
+import zlib
 from common.socket import Socket
 from common.utils import Bet
 
-BET_SEPARATOR = '|'
-BATCH_SEPARATOR = '#'
 WINNER_SEPARATOR = '$'
 
+# each bet field is sent as a uint16 length followed by its utf-8 bytes
 BET_PARTS = 6
+FIELD_LENGTH_SIZE = 2
+
+# every batch and winners payload travels in a frame made of a version byte
+# and a uint32 length, followed by the payload itself
+FRAME_VERSION = 1
+FRAME_HEADER_SIZE = 5
 
 SENDING_BETS = b'\x00'
 BATCH_RECEIVED = b'\x01'
@@ -14,68 +23,454 @@ REQUEST_RESULTS = b'\x02'
 RESULTS_NOT_READY = b'\x03'
 SENDING_RESULTS = b'\x04'
 ERROR_CODE = b'\x05'
+HELLO = b'\x06'
+HELLO_ACK = b'\x07'
+BATCH_ALREADY_STORED = b'\x08'
+AUTH = b'\x09'
+AUTH_CHALLENGE = b'\x0a'
+AUTH_OK = b'\x0b'
+BATCH_CORRUPTED = b'\x0c'
+
+# Version advertised in the handshake. Version 1 is the legacy protocol,
+# spoken by clients that do not perform the handshake
+PROTOCOL_VERSION = 2
+LEGACY_PROTOCOL_VERSION = 1
+
+# Feature flags negotiated in the handshake
+FEATURE_WIDE_IDS = 1 << 0
+FEATURE_COMPRESSION = 1 << 1
+FEATURE_RESUMABLE_UPLOAD = 1 << 2
+FEATURE_PIPELINING = 1 << 3
+FEATURE_IDEMPOTENT_BATCHES = 1 << 4
+# only negotiated if the server has agency secrets, in which case it is
+# mandatory
+FEATURE_AUTHENTICATION = 1 << 5
+FEATURE_CHECKSUMS = 1 << 6
+FEATURE_STRUCTURED_ERRORS = 1 << 7
+
+SERVER_FEATURES = (FEATURE_WIDE_IDS | FEATURE_COMPRESSION | FEATURE_PIPELINING |
+                   FEATURE_RESUMABLE_UPLOAD | FEATURE_IDEMPOTENT_BATCHES | FEATURE_CHECKSUMS |
+                   FEATURE_STRUCTURED_ERRORS)
+# legacy clients already send the agency id as an uint32
+LEGACY_FEATURES = FEATURE_WIDE_IDS
+
+# when pipelining, every batch frame starts with its uint32 sequence number
+# and every acknowledgement carries the sequence number it refers to
+SEQUENCE_NUMBER_SIZE = 4
+# with idempotent batches, every batch frame starts with its id, made of the
+# uint32 agency id followed by the uint32 sequence number
+AGENCY_ID_SIZE = 4
+
+# with compression, every non empty frame payload starts with a byte
+# identifying how the rest of it is encoded
+CODEC_SIZE = 1
+CODEC_NONE = 0
+CODEC_GZIP = 1
+# wbits used by zlib to read and write gzip streams
+GZIP_WBITS = 16 + zlib.MAX_WBITS
+
+# with checksums, every non empty frame payload ends with the CRC-32 (IEEE,
+# as used by gzip) of the bytes before it
+CHECKSUM_SIZE = 4
+
+# with structured errors, ERROR_CODE is followed by one of these codes, the
+# uint32 sequence number of the batch and the uint32 index of the bet within
+# it the error refers to (NOT_APPLICABLE if it does not refer to them) and a
+# uint16 length-prefixed utf-8 message
+ERROR_UNKNOWN = 0
+ERROR_MALFORMED_MESSAGE = 1
+ERROR_INVALID_BET = 2
+ERROR_OUT_OF_ORDER_BATCH = 3
+ERROR_AGENCY_MISMATCH = 4
+ERROR_AUTHENTICATION_FAILED = 5
+NOT_APPLICABLE = 0xFFFFFFFF
+MAX_ERROR_MESSAGE_SIZE = 0xFFFF
+
+# size of the random challenge sent to authenticate an agency, which
+# answers with its HMAC-SHA256 keyed by the agency secret
+AUTH_NONCE_SIZE = 32
+AUTH_MAC_SIZE = 32
+
+# status of the agency upload, answered when the client resumes it
+UPLOAD_NOT_STARTED = 0
+UPLOAD_IN_PROGRESS = 1
+UPLOAD_COMPLETED = 2
+
+class ProtocolError(ValueError):
+    """
+    A request the server rejects, reported to the client with the error
+    code and, if known, the batch and the bet within it that caused it
+    """
+    def __init__(self, code, message, seq=None, bet_index=None):
+        super().__init__(message)
+        self.code = code
+        self.seq = seq
+        self.bet_index = bet_index
+
+class AuthenticationError(ProtocolError):
+    def __init__(self, message):
+        super().__init__(ERROR_AUTHENTICATION_FAILED, message)
+
+class ChecksumError(ValueError):
+    pass
 
 class Protocol:
-    def __init__(self, sock):
+    def __init__(self, sock, max_frame_size, secrets=None):
         self._sock = Socket(sock)
         self._sock_closed = False
+        self._max_frame_size = max_frame_size
+        # secret of each agency. If there are any, agencies must authenticate
+        self._secrets = secrets or {}
+        self._version = LEGACY_PROTOCOL_VERSION
+        self._features = LEGACY_FEATURES
+
+    def start_tls(self):
+        """
+        Completes the TLS handshake if the connection is encrypted
+        """
+        self._sock.do_handshake()
+
+    def handshake(self):
+        """
+        Receives the version and features advertised by the client, and
+        answers with the version and features that will be used
+        """
+        data = self._sock.recvall(5)
+        if len(data) < 5:
+            raise OSError('Connection closed during handshake')
+
+        client_version = data[0]
+        client_features = int.from_bytes(data[1:], byteorder='big', signed=False)
+        if client_version < LEGACY_PROTOCOL_VERSION:
+            raise ValueError(f'Unsupported protocol version: {client_version}')
+
+        supported_features = SERVER_FEATURES
+        if self.authentication_required():
+            supported_features |= FEATURE_AUTHENTICATION
+
+        version = min(client_version, PROTOCOL_VERSION)
+        features = client_features & supported_features
+        if version == LEGACY_PROTOCOL_VERSION:
+            features = LEGACY_FEATURES
+
+        # the client expects a bare ERROR_CODE until the handshake is
+        # answered, so the negotiated features are stored afterwards
+        if self.authentication_required() and not features & FEATURE_AUTHENTICATION:
+            raise AuthenticationError('Client does not support authentication')
+
+        self._version = version
+        self._features = features
+
+        buf = HELLO_ACK
+        buf += self._version.to_bytes(1, byteorder='big')
+        buf += self._features.to_bytes(4, byteorder='big')
+        self._sock.sendall(buf)
+
+    def authentication_required(self):
+        """
+        Returns true if agencies must authenticate before any other action
+        """
+        return bool(self._secrets)
+
+    def authenticate(self):
+        """
+        Challenges the client to prove it knows the secret of the agency it
+        claims to be, returning that agency. Raises AuthenticationError if
+        the agency is unknown or the answer is wrong
+        """
+        if self.receive_action() != AUTH:
+            raise AuthenticationError('Client did not authenticate')
+
+        agency = self.__receive_uint32()
+        nonce = os.urandom(AUTH_NONCE_SIZE)
+        self._sock.sendall(AUTH_CHALLENGE + nonce)
+
+        mac = self._sock.recvall(AUTH_MAC_SIZE)
+        if len(mac) < AUTH_MAC_SIZE:
+            raise OSError('Connection closed during authentication')
+
+        # unknown agencies are challenged too, so they cannot be told apart
+        secret = self._secrets.get(agency)
+        expected = None
+        if secret is not None:
+            message = nonce + agency.to_bytes(AGENCY_ID_SIZE, byteorder='big')
+            expected = hmac.new(secret, message, hashlib.sha256).digest()
+
+        if expected is None or not hmac.compare_digest(mac, expected):
+            raise AuthenticationError(f'Authentication failed for agency {agency}')
+
+        self._sock.sendall(AUTH_OK)
+        return agency
+
+    def resumable(self):
+        """
+        Returns true if the client identifies its agency before sending
+        bets, so an interrupted upload can be resumed
+        """
+        return bool(self._features & FEATURE_RESUMABLE_UPLOAD)
+
+    def compressed(self):
+        """
+        Returns true if every non empty frame payload starts with the codec
+        it is encoded with
+        """
+        return bool(self._features & FEATURE_COMPRESSION)
+
+    def checksummed(self):
+        """
+        Returns true if every non empty frame payload ends with a checksum
+        """
+        return bool(self._features & FEATURE_CHECKSUMS)
+
+    def idempotent(self):
+        """
+        Returns true if every batch carries a stable id, so a batch sent
+        more than once must be stored only once
+        """
+        return bool(self._features & FEATURE_IDEMPOTENT_BATCHES)
+
+    def __sequenced(self):
+        return bool(self._features & (FEATURE_PIPELINING | FEATURE_RESUMABLE_UPLOAD | FEATURE_IDEMPOTENT_BATCHES))
 
-    def deserialize_bet(self, serialized):
-        parts = serialized.split(BET_SEPARATOR)
-        if len(parts) != BET_PARTS:
-            return None
+    def send_upload_status(self, completed, last_seq):
+        """
+        Informs the client what was already stored from its upload. last_seq
+        is the sequence number of the last batch stored, or None
+        """
+        if completed:
+            status = UPLOAD_COMPLETED
+        elif last_seq is not None:
+            status = UPLOAD_IN_PROGRESS
+        else:
+            status = UPLOAD_NOT_STARTED
+
+        buf = status.to_bytes(1, byteorder='big')
+        buf += (last_seq or 0).to_bytes(SEQUENCE_NUMBER_SIZE, byteorder='big')
+        self._sock.sendall(buf)
+
+    def negotiate_max_frame_size(self):
+        """
+        Receives the max frame size requested by the client and answers
+        with the one that will be used, which is never greater than the
+        requested one nor the one configured in the server
+        """
+        requested = self.__receive_uint32()
+        if requested == 0:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, 'Invalid max frame size requested')
+
+        self._max_frame_size = min(requested, self._max_frame_size)
+        self._sock.sendall(self._max_frame_size.to_bytes(4, byteorder='big'))
+
+    def deserialize_bet(self, data, offset):
+        """
+        Decodes the length-prefixed fields of the bet starting at offset.
+        Returns the bet and the offset right after it, or None if the
+        data is truncated
+        """
+        parts = []
+        for _ in range(BET_PARTS):
+            if offset + FIELD_LENGTH_SIZE > len(data):
+                return None, offset
+            field_length = int.from_bytes(data[offset:offset + FIELD_LENGTH_SIZE], byteorder='big', signed=False)
+            offset += FIELD_LENGTH_SIZE
+
+            if offset + field_length > len(data):
+                return None, offset
+            parts.append(data[offset:offset + field_length].decode('utf-8'))
+            offset += field_length
 
         agency, first_name, last_name, document, birthday, number = parts
-        return Bet(agency, first_name, last_name, document, birthday, number)
+        return Bet(agency, first_name, last_name, document, birthday, number), offset
 
     def receive_bets_batch(self):
-        batch_length = self.__receive_uint16()
+        """
+        Receives a batch of bets, returning the agency from its id (only
+        if batches are idempotent), its sequence number and the bets.
+        An empty list of bets means the client finished sending them
+        """
+        batch_data = self.__receive_frame()
+
+        if not batch_data:
+            return None, None, []
+
+        if self.checksummed():
+            batch_data = self.__verify_checksum(batch_data)
+
+        if self.compressed():
+            batch_data = self.__decode_payload(batch_data)
 
-        if batch_length == 0:
-            return []
-        
-        batch_data = self._sock.recvall(batch_length).decode('utf-8')
+        offset = 0
+        agency = None
+        if self.idempotent():
+            if len(batch_data) < AGENCY_ID_SIZE:
+                raise ProtocolError(ERROR_MALFORMED_MESSAGE, 'Batch without id')
+            agency = int.from_bytes(batch_data[:AGENCY_ID_SIZE], byteorder='big', signed=False)
+            offset = AGENCY_ID_SIZE
+
+        if self.__sequenced():
+            if len(batch_data) < offset + SEQUENCE_NUMBER_SIZE:
+                raise ProtocolError(ERROR_MALFORMED_MESSAGE, 'Batch without sequence number')
+            seq = int.from_bytes(batch_data[offset:offset + SEQUENCE_NUMBER_SIZE], byteorder='big', signed=False)
+            offset += SEQUENCE_NUMBER_SIZE
+        else:
+            seq = None
 
         bets = []
-        for serialized_bet in batch_data.split(BATCH_SEPARATOR):
-            bet = self.deserialize_bet(serialized_bet)
+        while offset < len(batch_data):
+            try:
+                bet, offset = self.deserialize_bet(batch_data, offset)
+            except ValueError as e:
+                logging.error(f'action: apuesta_recibida | result: fail | cantidad: {len(bets)}')
+                raise ProtocolError(ERROR_INVALID_BET, f'Invalid bet: {e}', seq, len(bets))
+
             if bet is None:
-                logging.error(f'action: apuesta_recibida | result: fail | cantidad: {batch_length}')
-                raise ValueError('Invalid bet format')
+                logging.error(f'action: apuesta_recibida | result: fail | cantidad: {len(bets)}')
+                raise ProtocolError(ERROR_MALFORMED_MESSAGE, 'Truncated bet', seq, len(bets))
             
             bets.append(bet)
             
-        return bets
+        return agency, seq, bets
     
     def receive_action(self):
         return self._sock.recvall(1)
     
     def receive_agency_id(self):
+        if self._features & FEATURE_WIDE_IDS:
+            return self.__receive_uint32()
         return ord(self._sock.recvall(1))
 
     def send_winners(self, winners):
         buf = b''
         serialized_winners = WINNER_SEPARATOR.join(winners).encode('utf-8')
+        if self.compressed() and serialized_winners:
+            serialized_winners = self.__encode_payload(serialized_winners)
+        if self.checksummed() and serialized_winners:
+            serialized_winners += zlib.crc32(serialized_winners).to_bytes(CHECKSUM_SIZE, byteorder='big')
         winners_len = len(serialized_winners)
 
         buf += SENDING_RESULTS
-        buf += winners_len.to_bytes(2, byteorder='big')
+        buf += FRAME_VERSION.to_bytes(1, byteorder='big')
+        buf += winners_len.to_bytes(4, byteorder='big')
         buf += serialized_winners
 
         self._sock.sendall(buf)
-        
-    def __receive_uint16(self):
-        data = self._sock.recvall(2)
+
+    def __receive_frame(self):
+        header = self._sock.recvall(FRAME_HEADER_SIZE)
+        if len(header) < FRAME_HEADER_SIZE:
+            raise OSError('Connection closed while receiving frame')
+
+        if header[0] != FRAME_VERSION:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, f'Unsupported frame version: {header[0]}')
+
+        length = int.from_bytes(header[1:], byteorder='big', signed=False)
+        if length > self._max_frame_size:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, f'Frame of {length} bytes exceeds max frame size of {self._max_frame_size} bytes')
+
+        data = self._sock.recvall(length)
+        if len(data) < length:
+            raise OSError('Connection closed while receiving frame')
+
+        return data
+
+    def __verify_checksum(self, payload):
+        """
+        Returns the payload without its checksum, raising ChecksumError if
+        it does not match
+        """
+        if len(payload) < CHECKSUM_SIZE:
+            raise ChecksumError(f'Frame of {len(payload)} bytes can not hold a checksum')
+
+        data = payload[:-CHECKSUM_SIZE]
+        expected = int.from_bytes(payload[-CHECKSUM_SIZE:], byteorder='big', signed=False)
+        actual = zlib.crc32(data)
+        if actual != expected:
+            raise ChecksumError(f'Checksum mismatch: expected {expected:08x}, got {actual:08x}')
+
+        return data
+
+    def __encode_payload(self, payload):
+        """
+        Prefixes the payload with its codec, compressing it only if that
+        makes it smaller
+        """
+        compressor = zlib.compressobj(wbits=GZIP_WBITS)
+        compressed = compressor.compress(payload) + compressor.flush()
+        if len(compressed) < len(payload):
+            return CODEC_GZIP.to_bytes(CODEC_SIZE, byteorder='big') + compressed
+        return CODEC_NONE.to_bytes(CODEC_SIZE, byteorder='big') + payload
+
+    def __decode_payload(self, payload):
+        """
+        Decodes a payload prefixed by its codec. The decoded payload can not
+        be longer than the max frame size, so a small frame can not expand
+        into an arbitrarily large one
+        """
+        if len(payload) < CODEC_SIZE:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, 'Frame without codec')
+
+        codec, data = payload[0], payload[CODEC_SIZE:]
+        if codec == CODEC_NONE:
+            return data
+        if codec != CODEC_GZIP:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, f'Unsupported codec: {codec}')
+
+        decompressor = zlib.decompressobj(wbits=GZIP_WBITS)
+        try:
+            decoded = decompressor.decompress(data, self._max_frame_size + 1)
+        except zlib.error as e:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, f'Invalid compressed frame: {e}')
+
+        if len(decoded) > self._max_frame_size:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, f'Decompressed frame exceeds max frame size of {self._max_frame_size} bytes')
+        if not decompressor.eof or decompressor.unused_data:
+            raise ProtocolError(ERROR_MALFORMED_MESSAGE, 'Invalid compressed frame: truncated or trailing data')
+
+        return decoded
+
+    def __receive_uint32(self):
+        data = self._sock.recvall(4)
         return int.from_bytes(data, byteorder='big', signed=False)
 
     def send_results_not_ready(self):
         self._sock.sendall(RESULTS_NOT_READY)
 
-    def confirm_reception(self):
-        self._sock.sendall(BATCH_RECEIVED)
+    def confirm_reception(self, seq):
+        self.__send_ack(BATCH_RECEIVED, seq)
+
+    def confirm_already_stored(self, seq):
+        self.__send_ack(BATCH_ALREADY_STORED, seq)
+
+    def __send_ack(self, code, seq):
+        buf = code
+        if self.__sequenced():
+            buf += seq.to_bytes(SEQUENCE_NUMBER_SIZE, byteorder='big')
+        self._sock.sendall(buf)
+
+    def send_batch_corrupted(self):
+        self._sock.sendall(BATCH_CORRUPTED)
+
+    def send_error_code(self, error=None):
+        """
+        Reports the error to the client, with its details if structured
+        errors were negotiated
+        """
+        buf = ERROR_CODE
+        if self._features & FEATURE_STRUCTURED_ERRORS:
+            code = getattr(error, 'code', ERROR_UNKNOWN)
+            seq = getattr(error, 'seq', None)
+            bet_index = getattr(error, 'bet_index', None)
+            # truncated bytes may split a character, which is dropped
+            message = str(error or '').encode('utf-8')[:MAX_ERROR_MESSAGE_SIZE]
+            message = message.decode('utf-8', 'ignore').encode('utf-8')
 
-    def send_error_code(self):
-        self._sock.sendall(ERROR_CODE)
+            buf += code.to_bytes(1, byteorder='big')
+            buf += (NOT_APPLICABLE if seq is None else seq).to_bytes(SEQUENCE_NUMBER_SIZE, byteorder='big')
+            buf += (NOT_APPLICABLE if bet_index is None else bet_index).to_bytes(4, byteorder='big')
+            buf += len(message).to_bytes(FIELD_LENGTH_SIZE, byteorder='big')
+            buf += message
+
+        self._sock.sendall(buf)
 
     def close(self):
         if not self._sock_closed:
@@ -1,19 +1,29 @@
 import socket
 import logging
-from common.protocol import Protocol, SENDING_BETS, REQUEST_RESULTS
+from common.protocol import Protocol, ProtocolError, AuthenticationError, ChecksumError, SENDING_BETS, REQUEST_RESULTS, HELLO
+from common.protocol import ERROR_OUT_OF_ORDER_BATCH, ERROR_AGENCY_MISMATCH
 from common.utils import store_bets, load_bets, has_won
 from threading import Thread, Lock
 
 class Server:
-    def __init__(self, port, listen_backlog, number_of_agencies):
+    def __init__(self, port, listen_backlog, number_of_agencies, max_frame_size, ssl_context=None, secrets=None):
         # Initialize server socket
         self._server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
         self._server_socket.bind(('', port))
         self._server_socket.listen(listen_backlog)
         self._keep_running = True
         self._number_of_agencies = number_of_agencies
+        self._max_frame_size = max_frame_size
+        # connections are encrypted with TLS if a context is given
+        self._ssl_context = ssl_context
+        # secret of each agency. If there are any, agencies must authenticate
+        self._secrets = secrets or {}
         self._processed_agencies = 0
         self._winners = {}
+        # sequence number of the last batch stored from each agency, and the
+        # agencies that finished sending their bets, to resume uploads
+        self._uploads = {}
+        self._completed_uploads = set()
         self._client_handlers = set()
         self._lock = Lock()
 
@@ -27,7 +37,12 @@ class Server:
         while self._keep_running:
             client_sock = self.__accept_new_connection()
             if client_sock is not None:
-                protocol = Protocol(client_sock)
+                if self._ssl_context is not None:
+                    # the TLS handshake is completed by the client handler,
+                    # so a slow client does not block the accept loop
+                    client_sock = self._ssl_context.wrap_socket(client_sock, server_side=True,
+                                                                do_handshake_on_connect=False)
+                protocol = Protocol(client_sock, self._max_frame_size, self._secrets)
                 thread = Thread(target=self.__handle_client_connection, args=(protocol,))
                 self._client_handlers.add((thread, protocol))
         
@@ -42,34 +57,72 @@ class Server:
         Handles a client connection, identifying the action to take
         """
         try:
+            protocol.start_tls()
+            # agency proven by the client, if authentication is required
+            agency = None
             action = protocol.receive_action()
+            if action == HELLO:
+                protocol.handshake()
+                if protocol.authentication_required():
+                    agency = protocol.authenticate()
+                    logging.debug(f'action: authenticate | result: success | agency: {agency}')
+                action = protocol.receive_action()
+            elif protocol.authentication_required():
+                raise AuthenticationError('Legacy clients cannot authenticate')
+
             if action == SENDING_BETS:
-                self.__handle_sending_bets(protocol)
+                self.__handle_sending_bets(protocol, agency)
 
             elif action == REQUEST_RESULTS:
-                self.__handle_request_results(protocol)
+                self.__handle_request_results(protocol, agency)
 
         except OSError as e:
             logging.error(f'action: receive_message | result: fail | error: {e}')
+        except ChecksumError as e:
+            # the framing may be broken too, so the connection is closed
+            # and the client sends the batch again in a new one
+            logging.error(f'action: checksum_mismatch | result: fail | error: {e}')
+            protocol.send_batch_corrupted()
+        except AuthenticationError as e:
+            logging.error(f'action: authenticate | result: fail | error: {e}')
+            protocol.send_error_code(e)
         except ValueError as e:
             logging.error(f'action: receive_message | result: fail | error: {e}')
-            protocol.send_error_code()
+            protocol.send_error_code(e)
         finally:
             protocol.close()
 
-    def __handle_sending_bets(self, protocol):
+    def __handle_sending_bets(self, protocol, authenticated_agency):
         """
         Handles a client that wants to send bets
         If its the last agency, it will perform the raffle
         """
         logging.debug('action: receive_bets | result: in_progress')
+        protocol.negotiate_max_frame_size()
+
+        agency = authenticated_agency
+        if protocol.resumable():
+            agency = protocol.receive_agency_id()
+            self.__check_agency(authenticated_agency, agency)
+            with self._lock:
+                completed = agency in self._completed_uploads
+                last_seq = self._uploads.get(agency)
+
+            protocol.send_upload_status(completed, last_seq)
+            if completed:
+                logging.debug(f'action: resume_upload | result: success | agency: {agency} | info: already completed')
+                return
 
         while self._keep_running:
-            bets_batch = protocol.receive_bets_batch()
+            batch_agency, seq, bets_batch = protocol.receive_bets_batch()
 
             if not bets_batch:
                 logging.debug('action: receive_bets | result: success | info: no more bets')
                 with self._lock:
+                    if agency is not None:
+                        if agency in self._completed_uploads:
+                            return
+                        self._completed_uploads.add(agency)
                     self._processed_agencies += 1
                     
                     if self._processed_agencies == self._number_of_agencies:
@@ -78,18 +131,63 @@ class Server:
                 
                 return
 
-            protocol.confirm_reception()
-            
-            with self._lock:
-                store_bets(bets_batch)
+            if batch_agency is not None:
+                if agency is not None and batch_agency != agency:
+                    raise ProtocolError(ERROR_AGENCY_MISMATCH,
+                                        f'Batch from agency {batch_agency} received in upload of agency {agency}', seq)
+                agency = batch_agency
+
+            for index, bet in enumerate(bets_batch):
+                self.__check_agency(authenticated_agency, bet.agency, seq, index)
+
+            # The batch is acknowledged once stored, so the client can
+            # resume right after the last acknowledged batch
+            if not self.__store_batch(protocol, agency, seq, bets_batch):
+                protocol.confirm_already_stored(seq)
+                logging.info(f'action: apuesta_recibida | result: already_stored | cantidad: {len(bets_batch)}')
+                continue
+
+            protocol.confirm_reception(seq)
                 
             logging.info(f'action: apuesta_recibida | result: success | cantidad: {len(bets_batch)}')
 
-    def __handle_request_results(self, protocol):
+    def __store_batch(self, protocol, agency, seq, bets_batch):
+        """
+        Stores the batch, checking that it follows the last one stored from
+        the agency if it is known. If batches are idempotent and it was
+        already stored, returns False without storing it again
+        """
+        with self._lock:
+            if agency is not None:
+                last_seq = self._uploads.get(agency)
+                if protocol.idempotent() and last_seq is not None and seq <= last_seq:
+                    return False
+
+                expected_seq = 0 if last_seq is None else last_seq + 1
+                if seq != expected_seq:
+                    raise ProtocolError(ERROR_OUT_OF_ORDER_BATCH, f'Unexpected batch {seq}, expected {expected_seq}', seq)
+
+            store_bets(bets_batch)
+            if agency is not None:
+                self._uploads[agency] = seq
+
+        return True
+
+    def __check_agency(self, authenticated_agency, agency, seq=None, bet_index=None):
+        """
+        Checks an authenticated client only acts on behalf of its own agency
+        """
+        if authenticated_agency is not None and agency != authenticated_agency:
+            raise ProtocolError(ERROR_AGENCY_MISMATCH,
+                                f'Agency {authenticated_agency} cannot act on behalf of agency {agency}',
+                                seq, bet_index)
+
+    def __handle_request_results(self, protocol, authenticated_agency):
         """
         Handles a client that wants to request results of the raffle
         """
         agency = protocol.receive_agency_id()
+        self.__check_agency(authenticated_agency, agency)
         winners = []
         ready = False
         with self._lock:
@@ -1,7 +1,13 @@
+import ssl
+
 class Socket:
     def __init__(self, sock):
         self._sock = sock
 
+    def do_handshake(self):
+        if isinstance(self._sock, ssl.SSLSocket):
+            self._sock.do_handshake()
+
     def sendall(self, data):
         self._sock.sendall(data)
 
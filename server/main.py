@@ -5,6 +5,7 @@ from common.server import Server
 import logging
 import os
 import signal
+import ssl
 
 
 def initialize_config():
@@ -28,6 +29,11 @@ def initialize_config():
         config_params["listen_backlog"] = int(os.getenv('SERVER_LISTEN_BACKLOG', config["DEFAULT"]["SERVER_LISTEN_BACKLOG"]))
         config_params["logging_level"] = os.getenv('LOGGING_LEVEL', config["DEFAULT"]["LOGGING_LEVEL"])
         config_params["number_of_agencies"] = int(os.getenv('NUMBEROFAGENCIES', config["DEFAULT"]["NUMBEROFAGENCIES"]))
+        config_params["max_frame_size"] = int(os.getenv('SERVER_MAX_FRAME_SIZE', config["DEFAULT"]["SERVER_MAX_FRAME_SIZE"]))
+        config_params["tls_cert"] = os.getenv('SERVER_TLS_CERT', config["DEFAULT"].get("SERVER_TLS_CERT", ""))
+        config_params["tls_key"] = os.getenv('SERVER_TLS_KEY', config["DEFAULT"].get("SERVER_TLS_KEY", ""))
+        config_params["tls_ca"] = os.getenv('SERVER_TLS_CA', config["DEFAULT"].get("SERVER_TLS_CA", ""))
+        config_params["auth_secrets_file"] = os.getenv('SERVER_AUTH_SECRETS_FILE', config["DEFAULT"].get("SERVER_AUTH_SECRETS_FILE", ""))
     except KeyError as e:
         raise KeyError("Key was not found. Error: {} .Aborting server".format(e))
     except ValueError as e:
@@ -42,21 +48,68 @@ def main():
     port = config_params["port"]
     listen_backlog = config_params["listen_backlog"]
     number_of_agencies = config_params["number_of_agencies"]
+    max_frame_size = config_params["max_frame_size"]
 
     initialize_log(logging_level)
 
+    ssl_context = initialize_tls(config_params["tls_cert"], config_params["tls_key"], config_params["tls_ca"])
+    secrets = load_agency_secrets(config_params["auth_secrets_file"])
+
     # Log config parameters at the beginning of the program to verify the configuration
     # of the component
     logging.debug(f"action: config | result: success | port: {port} | "
-                  f"listen_backlog: {listen_backlog} | logging_level: {logging_level}")
+                  f"listen_backlog: {listen_backlog} | logging_level: {logging_level} | "
+                  f"tls: {ssl_context is not None} | auth: {bool(secrets)}")
 
     # Initialize server and start server loop
-    server = Server(port, listen_backlog, number_of_agencies)
+    server = Server(port, listen_backlog, number_of_agencies, max_frame_size, ssl_context, secrets)
 
     signal.signal(signal.SIGTERM, server.stop)
 
     server.run()
 
+def initialize_tls(cert_file, key_file, ca_file):
+    """
+    Builds the TLS context used to accept connections, or returns None if
+    no certificate is configured. If a CA bundle is configured, agencies
+    must present a client certificate signed by it
+    """
+    if not cert_file:
+        return None
+
+    context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+    context.minimum_version = ssl.TLSVersion.TLSv1_2
+    context.load_cert_chain(cert_file, key_file or None)
+    if ca_file:
+        context.load_verify_locations(ca_file)
+        context.verify_mode = ssl.CERT_REQUIRED
+
+    return context
+
+def load_agency_secrets(secrets_file):
+    """
+    Loads the secret of each agency from a file with one `agency=secret`
+    line per agency. Blank lines and lines starting with # are ignored.
+    Returns an empty dict if no file is configured, in which case agencies
+    do not authenticate
+    """
+    if not secrets_file:
+        return {}
+
+    secrets = {}
+    with open(secrets_file) as file:
+        for line in file:
+            line = line.strip()
+            if not line or line.startswith('#'):
+                continue
+
+            agency, separator, secret = line.partition('=')
+            if not separator or not secret.strip():
+                raise ValueError(f'Invalid line in agency secrets file: agency {agency.strip()}')
+            secrets[int(agency)] = secret.strip().encode('utf-8')
+
+    return secrets
+
 def initialize_log(logging_level):
     """
     Python custom logging initialization
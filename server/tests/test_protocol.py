@@ -0,0 +1,43 @@
+from common.protocol import *
+import socket
+import threading
+import unittest
+
+class TestProtocol(unittest.TestCase):
+
+    def setUp(self):
+        self.client, server = socket.socketpair()
+        self.protocol = Protocol(server, 1024)
+
+    def tearDown(self):
+        self.client.close()
+        self.protocol.close()
+
+    def test_frame_with_only_checksum_must_be_malformed(self):
+        # the CRC-32 of no bytes is 0, so the checksum matches and leaves
+        # nothing to read the codec from
+        self.protocol._features = FEATURE_COMPRESSION | FEATURE_CHECKSUMS
+        self.client.sendall(b'\x01\x00\x00\x00\x04\x00\x00\x00\x00')
+
+        with self.assertRaises(ProtocolError) as context:
+            self.protocol.receive_bets_batch()
+        self.assertEqual(context.exception.code, ERROR_MALFORMED_MESSAGE)
+
+    def test_long_error_message_must_not_split_characters(self):
+        self.protocol._features = FEATURE_STRUCTURED_ERRORS
+        # an odd amount of bytes is allowed, so the last 'ñ' kept is split
+        error = ProtocolError(ERROR_INVALID_BET, 'ñ' * (MAX_ERROR_MESSAGE_SIZE // 2 + 1))
+        sender = threading.Thread(target=self.protocol.send_error_code, args=(error,))
+        sender.start()
+
+        header_size = 1 + 1 + SEQUENCE_NUMBER_SIZE + 4
+        header = self.client.recv(header_size + FIELD_LENGTH_SIZE, socket.MSG_WAITALL)
+        length = int.from_bytes(header[header_size:], byteorder='big', signed=False)
+        message = self.client.recv(length, socket.MSG_WAITALL)
+        sender.join()
+
+        self.assertEqual(length, MAX_ERROR_MESSAGE_SIZE - 1)
+        self.assertEqual(message.decode('utf-8'), 'ñ' * (MAX_ERROR_MESSAGE_SIZE // 2))
+
+if __name__ == '__main__':
+    unittest.main()